@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"shodone/internal/client"
+	"shodone/internal/config"
+	"shodone/internal/keyio"
+	"shodone/internal/storage"
+)
+
+// runCommand runs a maintenance command instead of the server
+func runCommand(name string, args []string, cfg *config.Config, db *storage.DB, logger *log.Logger) error {
+	switch name {
+	case "import-keys":
+		return importKeys(args, cfg, db, logger)
+	case "export-keys":
+		return exportKeys(args, db)
+	case "rotate-master-key":
+		return rotateMasterKey(args, db, logger)
+	}
+	return fmt.Errorf("unknown command %q (available: import-keys, export-keys, rotate-master-key)", name)
+}
+
+// importKeys adds the keys of a file, or of stdin if the file is "-"
+func importKeys(args []string, cfg *config.Config, db *storage.DB, logger *log.Logger) error {
+	flags := flag.NewFlagSet("import-keys", flag.ContinueOnError)
+	format := flags.String("format", keyio.FormatText, "input format: text, csv or json")
+	validate := flags.Bool("validate", true, "check each key against /api-info before adding it")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: shodone import-keys [-format text|csv|json] [-validate=false] FILE")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("missing input file")
+	}
+
+	parsedFormat, err := keyio.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	var input io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		defer file.Close()
+		input = file
+	}
+	records, err := keyio.Parse(parsedFormat, input)
+	if err != nil {
+		return err
+	}
+
+	importer := &keyio.Importer{
+		DB:                db,
+		DefaultQuotaLimit: cfg.DefaultQuotaLimit,
+	}
+	if *validate {
+		importer.Validate = keyValidator(cfg)
+	}
+
+	results := importer.Import(records)
+	for _, result := range results {
+		switch result.Status {
+		case keyio.StatusAdded:
+			fmt.Printf("row %d %s: %s (id %d)\n", result.Row, result.Key, result.Status, result.ID)
+		default:
+			fmt.Printf("row %d %s: %s (%s)\n", result.Row, result.Key, result.Status, result.Error)
+		}
+	}
+	logger.Infof("Imported %d/%d API keys", keyio.Count(results, keyio.StatusAdded), len(records))
+	return nil
+}
+
+// keyValidator returns a function checking a key against /api-info,
+// which returns the account information of valid keys
+func keyValidator(cfg *config.Config) func(key string) (*client.KeyInfo, error) {
+	apiClient := client.New(cfg.APIHost)
+	timeout := time.Duration(cfg.RefreshTimeout) * time.Second
+	return func(key string) (*client.KeyInfo, error) {
+		return apiClient.ValidateAPIKey(context.Background(), key, timeout)
+	}
+}
+
+// exportKeys writes all keys to a file, or to stdout if no file is given
+func exportKeys(args []string, db *storage.DB) error {
+	flags := flag.NewFlagSet("export-keys", flag.ContinueOnError)
+	format := flags.String("format", keyio.FormatJSON, "output format: text, csv or json")
+	unmasked := flags.Bool("unmasked", false, "write the full keys instead of masked ones")
+	output := flags.String("o", "-", "output file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	parsedFormat, err := keyio.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	keys, err := db.GetAllAPIKeys()
+	if err != nil {
+		return fmt.Errorf("failed to get API keys: %w", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", *output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	return keyio.Write(parsedFormat, w, keyio.FromAPIKeys(keys, *unmasked))
+}
+
+// rotateMasterKey re-encrypts all keys with the master key read from
+// SHODONE_NEW_MASTER_KEY or SHODONE_NEW_MASTER_KEY_FILE
+func rotateMasterKey(args []string, db *storage.DB, logger *log.Logger) error {
+	flags := flag.NewFlagSet("rotate-master-key", flag.ContinueOnError)
+	decrypt := flags.Bool("decrypt", false, "store the keys in plaintext instead of using a new master key")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: SHODONE_NEW_MASTER_KEY=... shodone rotate-master-key [-decrypt]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var newMasterKey []byte
+	if !*decrypt {
+		var err error
+		newMasterKey, err = loadMasterKey("SHODONE_NEW_MASTER_KEY", "SHODONE_NEW_MASTER_KEY_FILE")
+		if err != nil {
+			return fmt.Errorf("failed to load new master key: %w", err)
+		}
+		if newMasterKey == nil {
+			flags.Usage()
+			return errors.New("no new master key set")
+		}
+	}
+
+	if err := db.RotateMasterKey(newMasterKey); err != nil {
+		return err
+	}
+	if *decrypt {
+		logger.Info("API keys decrypted, unset SHODONE_MASTER_KEY before the next start")
+	} else {
+		logger.Info("API keys re-encrypted, use the new master key as SHODONE_MASTER_KEY from now on")
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"shodone/internal/config"
+	"shodone/internal/keyio"
+	"shodone/internal/storage"
+)
+
+// shodanKeyFiles are where the Shodan CLI stores its key, relative to
+// the home directory: the current location of `shodan init` and the legacy one
+var shodanKeyFiles = []string{
+	filepath.Join(".config", "shodan", "api_key"),
+	filepath.Join(".shodan", "api_key"),
+}
+
+// discoverKeys finds the keys of the local machine: SHODAN_API_KEY,
+// the Shodan CLI key files and the files listed in SHODONE_KEYS_FILE
+// (separated like PATH, in the format given by their extension)
+// Each key is returned once, noting where it was found
+func discoverKeys(logger *log.Logger) []keyio.Record {
+	var records []keyio.Record
+	seen := make(map[string]bool)
+	add := func(source string, found []keyio.Record) {
+		for _, record := range found {
+			record.Key = strings.TrimSpace(record.Key)
+			if record.Key == "" || seen[record.Key] {
+				continue
+			}
+			seen[record.Key] = true
+			if record.Notes == "" {
+				record.Notes = "discovered from " + source
+			}
+			records = append(records, record)
+		}
+	}
+
+	if key := os.Getenv("SHODAN_API_KEY"); key != "" {
+		add("SHODAN_API_KEY", []keyio.Record{{Key: key}})
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range shodanKeyFiles {
+			path := filepath.Join(home, name)
+			found, err := readKeyFile(path, keyio.FormatText)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				logger.Warnf("Failed to read API keys from %s: %v", path, err)
+				continue
+			}
+			add(path, found)
+		}
+	}
+
+	for _, path := range filepath.SplitList(os.Getenv("SHODONE_KEYS_FILE")) {
+		if path == "" {
+			continue
+		}
+		found, err := readKeyFile(path, formatFromExtension(path))
+		if err != nil {
+			logger.Warnf("Failed to read API keys from %s: %v", path, err)
+			continue
+		}
+		add(path, found)
+	}
+
+	return records
+}
+
+// readKeyFile parses the keys of a file
+func readKeyFile(path, format string) ([]keyio.Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return keyio.Parse(format, file)
+}
+
+// formatFromExtension returns the format of a key file from its extension,
+// text if it is neither .csv nor .json
+func formatFromExtension(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return keyio.FormatCSV
+	case ".json":
+		return keyio.FormatJSON
+	}
+	return keyio.FormatText
+}
+
+// importDiscoveredKeys adds the discovered keys that are valid and not stored yet
+func importDiscoveredKeys(cfg *config.Config, db *storage.DB, logger *log.Logger) {
+	records := discoverKeys(logger)
+	if len(records) == 0 {
+		logger.Info("No API keys discovered")
+		return
+	}
+
+	importer := &keyio.Importer{
+		DB:                db,
+		DefaultQuotaLimit: cfg.DefaultQuotaLimit,
+		Validate:          keyValidator(cfg),
+	}
+	results := importer.Import(records)
+	for _, result := range results {
+		switch result.Status {
+		case keyio.StatusAdded:
+			logger.Infof("Imported discovered API key %s (%s)", result.Key, records[result.Row-1].Notes)
+		case keyio.StatusDuplicate:
+			logger.Debugf("Discovered API key %s is already stored", result.Key)
+		default:
+			logger.Warnf("Skipped discovered API key %s: %s", result.Key, result.Error)
+		}
+	}
+	logger.Infof("Imported %d/%d discovered API keys", keyio.Count(results, keyio.StatusAdded), len(records))
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"shodone/internal/api"
@@ -40,17 +44,46 @@ func main() {
 		logger.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Load the master key encrypting API keys at rest
+	masterKey, err := loadMasterKey("SHODONE_MASTER_KEY", "SHODONE_MASTER_KEY_FILE")
+	if err != nil {
+		logger.Fatalf("Failed to load master key: %v", err)
+	}
+	if masterKey == nil {
+		logger.Warn("No master key set, API keys are stored in plaintext")
+	}
+
 	// Initialize database
-	db, err := storage.New(cfg.DatabasePath)
+	db, err := storage.New(cfg.DatabasePath, masterKey)
 	if err != nil {
 		logger.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
 
-	// Initialize and start API server
+	// Run a maintenance command instead of the server if one is given
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:], cfg, db, logger); err != nil {
+			logger.Errorf("Command %s failed: %v", os.Args[1], err)
+			db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Import the keys found on the machine if enabled
+	discover := cfg.DiscoverKeys
+	if enabled, err := strconv.ParseBool(os.Getenv("SHODONE_DISCOVER_KEYS")); err == nil {
+		discover = enabled
+	}
+	if discover {
+		importDiscoveredKeys(cfg, db, logger)
+	}
+
+	// Initialize and start API server and its background jobs
 	server := api.NewServer(cfg, db, logger)
+	server.StartScheduler()
 	go func() {
-		if err := server.Start(); err != nil {
+		if err := server.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Fatalf("Failed to start server: %v", err)
 		}
 	}()
@@ -66,3 +99,20 @@ func main() {
 	}
 	logger.Info("Server stopped")
 }
+
+// loadMasterKey reads a master key from the environment variable envName,
+// or from the file named by the environment variable fileEnvName
+// It returns nil if neither is set
+func loadMasterKey(envName, fileEnvName string) ([]byte, error) {
+	if encoded := os.Getenv(envName); encoded != "" {
+		return storage.ParseMasterKey(encoded)
+	}
+	if path := os.Getenv(fileEnvName); path != "" {
+		encoded, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		return storage.ParseMasterKey(string(encoded))
+	}
+	return nil, nil
+}
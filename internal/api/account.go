@@ -0,0 +1,121 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"shodone/internal/client"
+	"shodone/internal/storage"
+)
+
+// Account endpoints answered locally for the whole pool
+const (
+	apiInfoPath        = "/api-info"
+	accountProfilePath = "/account/profile"
+)
+
+// isAccountRequest reports whether a proxied request asks for account
+// information, which is answered from the pool instead of a single key
+func isAccountRequest(method, path string) bool {
+	return method == http.MethodGet && (path == apiInfoPath || path == accountProfilePath)
+}
+
+// answerAccountRequest answers /api-info or /account/profile with the
+// combined credits of the usable keys of a pool, all keys if empty
+func (s *Server) answerAccountRequest(c *gin.Context, path, pool string) {
+	keys, err := s.db.GetAllAPIKeys()
+	if err != nil {
+		s.logger.Errorf("Failed to get API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API keys"})
+		return
+	}
+
+	now := time.Now()
+	var pooled []*storage.APIKey
+	for _, key := range keys {
+		if isUsable(key, now) && (pool == "" || key.HasTag(pool)) {
+			pooled = append(pooled, key)
+		}
+	}
+
+	if path == accountProfilePath {
+		c.JSON(http.StatusOK, pooledProfile(pooled))
+		return
+	}
+	c.JSON(http.StatusOK, pooledAPIInfo(pooled))
+}
+
+// pooledAPIInfo sums up the credits and limits of keys as a single /api-info
+// An unlimited (-1) limit of any key makes the pooled limit unlimited
+// The https, unlocked and telnet flags are not tracked, so they are left out
+func pooledAPIInfo(keys []*storage.APIKey) gin.H {
+	var queryCredits, scanCredits, monitoredIPs int
+	var limits client.UsageLimits
+	plans := make(map[string]int)
+	for _, key := range keys {
+		queryCredits += max(key.QuotaLimit-key.QuotaUsed, 0)
+		scanCredits += key.ScanCredits
+		monitoredIPs += key.MonitoredIPs
+		limits.QueryCredits = addLimit(limits.QueryCredits, key.QueryCreditsLimit)
+		limits.ScanCredits = addLimit(limits.ScanCredits, key.ScanCreditsLimit)
+		limits.MonitoredIPs = addLimit(limits.MonitoredIPs, key.MonitoredIPsLimit)
+		if key.Plan != "" {
+			plans[key.Plan]++
+		}
+	}
+	return gin.H{
+		"query_credits": queryCredits,
+		"scan_credits":  scanCredits,
+		"monitored_ips": monitoredIPs,
+		"usage_limits":  limits,
+		"plan":          mostCommon(plans),
+	}
+}
+
+// addLimit adds two usage limits, where -1 means unlimited
+func addLimit(a, b int) int {
+	if a < 0 || b < 0 {
+		return -1
+	}
+	return a + b
+}
+
+// mostCommon returns the most counted name, the first in alphabetical order on ties
+func mostCommon(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var best string
+	for _, name := range names {
+		if best == "" || counts[name] > counts[best] {
+			best = name
+		}
+	}
+	return best
+}
+
+// pooledProfile returns an /account/profile for the pool
+// Export credits are not tracked, and the account dates from the oldest key
+func pooledProfile(keys []*storage.APIKey) gin.H {
+	var created time.Time
+	for _, key := range keys {
+		if created.IsZero() || key.CreatedAt.Before(created) {
+			created = key.CreatedAt
+		}
+	}
+	if created.IsZero() {
+		created = time.Now()
+	}
+	return gin.H{
+		"member":       len(keys) > 0,
+		"credits":      0,
+		"display_name": "shodone",
+		"created":      created.UTC().Format("2006-01-02T15:04:05.000000"),
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"shodone/internal/client"
+	"shodone/internal/keyio"
+)
+
+// importAPIKeys adds the keys of a newline list, CSV or JSON body
+// The format is taken from the `format` query parameter or the Content-Type,
+// and keys are checked against /api-info first unless `validate` is false
+func (s *Server) importAPIKeys(c *gin.Context) {
+	format, err := keyio.ParseFormat(c.DefaultQuery("format", keyio.FormatFromContentType(c.ContentType())))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	validate, err := strconv.ParseBool(c.DefaultQuery("validate", "true"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid validate parameter"})
+		return
+	}
+
+	records, err := keyio.Parse(format, c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	importer := &keyio.Importer{
+		DB:                s.db,
+		DefaultQuotaLimit: s.cfg.DefaultQuotaLimit,
+	}
+	if validate {
+		timeout := time.Duration(s.cfg.RefreshTimeout) * time.Second
+		importer.Validate = func(key string) (*client.KeyInfo, error) {
+			return s.client.ValidateAPIKey(c.Request.Context(), key, timeout)
+		}
+	}
+	results := importer.Import(records)
+
+	s.logger.Infof("Imported %d/%d API keys", keyio.Count(results, keyio.StatusAdded), len(records))
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "ok",
+		"total":      len(records),
+		"added":      keyio.Count(results, keyio.StatusAdded),
+		"duplicates": keyio.Count(results, keyio.StatusDuplicate),
+		"invalid":    keyio.Count(results, keyio.StatusInvalid),
+		"failed":     keyio.Count(results, keyio.StatusFailed),
+		"results":    results,
+	})
+}
+
+// exportAPIKeys writes all keys as a newline list, CSV or JSON
+// Keys are masked unless `unmasked` is set, and archived keys are
+// exported instead of the keys in use if `archived` is set
+func (s *Server) exportAPIKeys(c *gin.Context) {
+	format, err := keyio.ParseFormat(c.DefaultQuery("format", keyio.FormatJSON))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	unmasked, _ := strconv.ParseBool(c.Query("unmasked"))
+
+	keys, err := s.listedAPIKeys(c)
+	if err != nil {
+		s.logger.Errorf("Failed to get API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API keys"})
+		return
+	}
+	if unmasked {
+		s.logger.Warnf("Exporting %d unmasked API keys to %s", len(keys), c.ClientIP())
+	}
+
+	var buf bytes.Buffer
+	if err := keyio.Write(format, &buf, keyio.FromAPIKeys(keys, unmasked)); err != nil {
+		s.logger.Errorf("Failed to export API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export API keys"})
+		return
+	}
+	c.Data(http.StatusOK, keyio.ContentType(format), buf.Bytes())
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"shodone/internal/config"
+)
+
+// clientKeyParam is the query parameter carrying the Shodan key of a client,
+// as sent by the Shodan SDKs
+const clientKeyParam = "key"
+
+// resolveClientKey applies the client key mode to the key sent by a client
+// It returns the key to forward the request with, empty to use a pooled key,
+// and the pool to pick from, which an access token may restrict
+// It answers the request and returns false if the client is rejected
+func (s *Server) resolveClientKey(c *gin.Context, clientKey, pool string) (string, string, bool) {
+	switch s.cfg.ClientKeyMode {
+	case config.ClientKeyModePassthrough:
+		return clientKey, pool, true
+	case config.ClientKeyModeToken:
+		tokenPool, ok := s.cfg.AccessTokens[clientKey]
+		if clientKey == "" || !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid access token"})
+			return "", "", false
+		}
+		if tokenPool != "" {
+			pool = tokenPool
+		}
+		return "", pool, true
+	default:
+		return "", pool, true
+	}
+}
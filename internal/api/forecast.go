@@ -0,0 +1,151 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"shodone/internal/storage"
+)
+
+// minForecastSpan is the shortest spending history a rate is worked out
+// from, so that a key added a minute ago does not look like it burns its
+// credits in an hour
+const minForecastSpan = time.Hour
+
+// keyForecast predicts when a key runs out of query credits
+type keyForecast struct {
+	ID                 int        `json:"id"`
+	Key                string     `json:"key"`
+	Label              string     `json:"label"`
+	Unlimited          bool       `json:"unlimited"` // No quota limit
+	Remaining          int        `json:"remaining"`
+	SpendPerDay        float64    `json:"spend_per_day"`
+	RunsOutAt          *time.Time `json:"runs_out_at"` // nil if it never runs out at this rate
+	ResetsAt           *time.Time `json:"resets_at"`   // nil if the quota never resets
+	RunsOutBeforeReset bool       `json:"runs_out_before_reset"`
+}
+
+// poolForecast predicts when the usable keys of a pool run out of query credits
+type poolForecast struct {
+	Pool               string     `json:"pool"`
+	Keys               int        `json:"keys"`
+	Unlimited          bool       `json:"unlimited"` // Some key has no quota limit
+	Remaining          int        `json:"remaining"`
+	SpendPerDay        float64    `json:"spend_per_day"`
+	RunsOutAt          *time.Time `json:"runs_out_at"`
+	NextResetAt        *time.Time `json:"next_reset_at"` // Earliest reset of the keys
+	RunsOutBeforeReset bool       `json:"runs_out_before_reset"`
+}
+
+// getForecast returns when each usable key, and the pool as a whole,
+// runs out of query credits at the spending rate of the request log
+// The pool query parameter restricts it to the keys of a pool
+func (s *Server) getForecast(c *gin.Context) {
+	pool, keys, err := s.forecast(c.Query("pool"), time.Now())
+	if err != nil {
+		s.logger.Errorf("Failed to forecast API key usage: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to forecast API key usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"window": s.cfg.ForecastWindow,
+		"pool":   pool,
+		"keys":   keys,
+	})
+}
+
+// forecast predicts when the usable keys of a pool, all keys if empty, run out
+func (s *Server) forecast(pool string, now time.Time) (*poolForecast, []*keyForecast, error) {
+	window := time.Duration(s.cfg.ForecastWindow) * time.Second
+	since := now.Add(-window)
+	spent, err := s.db.GetQueryCreditsSpent(since)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := s.db.GetAllAPIKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	total := &poolForecast{Pool: pool}
+	forecasts := []*keyForecast{}
+	for _, key := range keys {
+		if !isUsable(key, now) || (pool != "" && !key.HasTag(pool)) {
+			continue
+		}
+
+		// Keys added during the window have spent for a shorter time
+		span := now.Sub(since)
+		if key.CreatedAt.After(since) {
+			span = now.Sub(key.CreatedAt)
+		}
+		span = max(span, minForecastSpan)
+
+		forecast := &keyForecast{
+			ID:          key.ID,
+			Key:         maskAPIKey(key.Key),
+			Label:       key.Label,
+			Unlimited:   key.QuotaLimit == 0,
+			Remaining:   max(key.QuotaLimit-key.QuotaUsed, 0),
+			SpendPerDay: float64(spent[key.ID]) / span.Hours() * 24,
+		}
+		if resetsAt := key.NextReset(now); !resetsAt.IsZero() {
+			forecast.ResetsAt = &resetsAt
+		}
+		if !forecast.Unlimited {
+			forecast.RunsOutAt = runsOutAt(now, forecast.Remaining, forecast.SpendPerDay)
+		}
+		forecast.RunsOutBeforeReset = runsOutBefore(forecast.RunsOutAt, forecast.ResetsAt)
+		forecasts = append(forecasts, forecast)
+
+		total.Keys++
+		total.Unlimited = total.Unlimited || forecast.Unlimited
+		total.Remaining += forecast.Remaining
+		total.SpendPerDay += forecast.SpendPerDay
+		if forecast.ResetsAt != nil && (total.NextResetAt == nil || forecast.ResetsAt.Before(*total.NextResetAt)) {
+			total.NextResetAt = forecast.ResetsAt
+		}
+	}
+	if !total.Unlimited {
+		total.RunsOutAt = runsOutAt(now, total.Remaining, total.SpendPerDay)
+	}
+	total.RunsOutBeforeReset = runsOutBefore(total.RunsOutAt, total.NextResetAt)
+
+	return total, forecasts, nil
+}
+
+// isUsable reports whether a key may serve requests now or after a short rest
+func isUsable(key *storage.APIKey, now time.Time) bool {
+	if !key.ExpiresAt.IsZero() && !key.ExpiresAt.After(now) {
+		return false
+	}
+	return key.State == storage.StateActive || key.State == storage.StateRateLimited
+}
+
+// runsOutAt returns when remaining credits are spent at a daily rate,
+// nil if nothing is spent or it is too far away to be represented
+func runsOutAt(now time.Time, remaining int, perDay float64) *time.Time {
+	if perDay <= 0 {
+		return nil
+	}
+	// Check the range in days first, converting would overflow time.Duration
+	days := float64(remaining) / perDay
+	if days >= float64(math.MaxInt64)/float64(24*time.Hour) {
+		return nil
+	}
+	at := now.Add(time.Duration(days * float64(24*time.Hour)))
+	return &at
+}
+
+// runsOutBefore reports whether credits run out before a reset,
+// which never comes if resetsAt is nil
+func runsOutBefore(runsOut, resetsAt *time.Time) bool {
+	if runsOut == nil {
+		return false
+	}
+	return resetsAt == nil || runsOut.Before(*resetsAt)
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"shodone/internal/storage"
+)
+
+// Page size of the request log
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 1000
+)
+
+// getLogs returns the request log, most recent first
+// It is filtered by the from, to (RFC 3339 or date), key, status and
+// path (prefix) query parameters, and paginated by limit and offset
+func (s *Server) getLogs(c *gin.Context) {
+	filter, err := parseLogFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	logs, total, err := s.db.GetRequestLogs(filter)
+	if err != nil {
+		s.logger.Errorf("Failed to get request log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get request log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":  total,
+		"limit":  filter.Limit,
+		"offset": filter.Offset,
+		"logs":   logs,
+	})
+}
+
+// parseLogFilter reads a request log filter from the query parameters
+func parseLogFilter(c *gin.Context) (storage.LogFilter, error) {
+	filter := storage.LogFilter{
+		Path:  c.Query("path"),
+		Limit: defaultLogLimit,
+	}
+
+	var err error
+	if filter.From, err = parseTimeParam(c, "from"); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseTimeParam(c, "to"); err != nil {
+		return filter, err
+	}
+	if filter.KeyID, err = parseIntParam(c, "key", 0); err != nil {
+		return filter, err
+	}
+	if filter.Status, err = parseIntParam(c, "status", 0); err != nil {
+		return filter, err
+	}
+	if filter.Limit, err = parseIntParam(c, "limit", defaultLogLimit); err != nil {
+		return filter, err
+	}
+	if filter.Offset, err = parseIntParam(c, "offset", 0); err != nil {
+		return filter, err
+	}
+	if filter.Limit <= 0 || filter.Limit > maxLogLimit {
+		return filter, fmt.Errorf("limit must be between 1 and %d", maxLogLimit)
+	}
+	return filter, nil
+}
+
+// parseTimeParam parses an RFC 3339 timestamp or date query parameter,
+// zero if it is not set
+func parseTimeParam(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return t, nil
+}
+
+// parseIntParam parses a non-negative integer query parameter,
+// fallback if it is not set
+func parseIntParam(c *gin.Context, name string, fallback int) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
@@ -0,0 +1,356 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"shodone/internal/cache"
+	"shodone/internal/cost"
+	"shodone/internal/plan"
+	"shodone/internal/storage"
+)
+
+// Header and query parameter selecting the key pool of a proxied request
+const (
+	poolHeader = "X-Shodone-Pool"
+	poolParam  = "pool"
+)
+
+// clientHeader identifies the client of a proxied request in the request log,
+// which falls back to the client IP
+const clientHeader = "X-Shodone-Client"
+
+// proxyRequest proxies a request to the configured API
+func (s *Server) proxyRequest(c *gin.Context) {
+	// Extract path and query parameters from the request
+	path := c.Param("path")
+	query := c.Request.URL.Query()
+
+	// Select the key pool from the header or the query parameter,
+	// which is not forwarded to the API
+	pool := c.GetHeader(poolHeader)
+	if pool == "" {
+		pool = query.Get(poolParam)
+	}
+	query.Del(poolParam)
+
+	// Take the key sent by the client out of the forwarded parameters,
+	// so it never overrides a pooled key
+	clientKey := query.Get(clientKeyParam)
+	query.Del(clientKeyParam)
+
+	// Log the request once answered
+	entry := &storage.RequestLog{
+		Timestamp: time.Now(),
+		Method:    c.Request.Method,
+		Path:      path,
+		Query:     cache.NormalizeQuery(query),
+		Client:    clientIdentity(c),
+	}
+	defer s.logRequest(c, entry)
+
+	// Handle the client key according to the client key mode
+	clientKey, pool, ok := s.resolveClientKey(c, clientKey, pool)
+	if !ok {
+		return
+	}
+
+	// Report the combined account information of the pool,
+	// unless the client uses its own key
+	if clientKey == "" && isAccountRequest(c.Request.Method, path) {
+		s.answerAccountRequest(c, path, pool)
+		return
+	}
+
+	// Answer identical GET requests from the cache
+	// Requests with the client's own key bypass it, since the upstream
+	// has to check that key before anything is served
+	var cacheKey string
+	cacheTTL := s.cfg.CacheTTLFor(path)
+	if s.cache != nil && clientKey == "" && c.Request.Method == http.MethodGet && cacheTTL > 0 {
+		cacheKey = cache.Key(c.Request.Method, path, query)
+		cached, err := s.cache.Get(cacheKey)
+		if err != nil {
+			s.logger.Errorf("Failed to read cache: %v", err)
+		}
+		if cached != nil {
+			s.logger.Debugf("Cache hit for %s", cacheKey)
+			entry.Cached = true
+			writeCachedResponse(c, cached)
+			return
+		}
+	}
+
+	// Buffer the request body so it can be replayed with another key
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		s.logger.Errorf("Failed to read request body: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	// Forward the request with the client's own key, which is neither
+	// charged nor failed over
+	if clientKey != "" {
+		s.logger.Debugf("Forwarding request to %s with client key %s", path, maskAPIKey(clientKey))
+		var bodyReader io.Reader
+		if len(body) > 0 {
+			bodyReader = bytes.NewReader(body)
+		}
+		resp, err := s.client.Do(c.Request.Method, path, bodyReader, clientKey, query)
+		if err != nil {
+			s.logger.Errorf("API request failed: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reach API"})
+			return
+		}
+		defer resp.Body.Close()
+		s.writeResponse(c, resp, "", 0)
+		return
+	}
+
+	// Work out the credits the request spends
+	charge := s.cost.Estimate(c.Request.Method, path, query, body)
+	s.logger.Debugf("Request to %s costs %d query and %d scan credits", path, charge.Query, charge.Scan)
+
+	// Get an available API key
+	criteria := storage.KeyCriteria{
+		QueryCredits: charge.Query,
+		ScanCredits:  charge.Scan,
+		Pool:         pool,
+		Strategy:     s.strategyFor(pool),
+	}
+
+	// Only pick keys whose plan supports the endpoint and filters
+	required := plan.Required(c.Request.Method, path, query)
+	if len(required) > 0 {
+		criteria.Plans = plan.Supporting(s.cfg.PlanCapabilities, required)
+		s.logger.Debugf("Request to %s requires %v, supported by plans %v", path, required, criteria.Plans)
+	}
+
+	key, err := s.acquireAPIKey(criteria, charge)
+	if err != nil {
+		s.logger.Errorf("Failed to get available API key: %v", err)
+		if len(required) > 0 {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error":    "No available API key with a plan supporting this request",
+				"requires": required,
+			})
+			return
+		}
+		if pool != "" {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No available API keys in pool " + pool})
+			return
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No available API keys"})
+		return
+	}
+
+	// Forward the request to the API, failing over to the next key
+	// when the upstream rejects the current one
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		attemptStart := time.Now()
+		// Log the forwarded request for debug
+		s.logger.Debugf("Forwarding request to %s with key %s (attempt %d)", path, maskAPIKey(key.Key), attempt)
+		s.logger.Debugf("URL: %s", c.Request.URL)
+		s.logger.Debugf("Method: %s", c.Request.Method)
+		s.logger.Debugf("Headers: %v", c.Request.Header)
+		s.logger.Debugf("Body: %s", body)
+		s.logger.Debugf("Params: %v", query)
+		s.logger.Debugf("Path: %s", path)
+
+		var bodyReader io.Reader
+		if len(body) > 0 {
+			bodyReader = bytes.NewReader(body)
+		}
+		resp, err = s.client.Do(c.Request.Method, path, bodyReader, key.Key, query)
+		if err != nil {
+			s.logger.Errorf("API request failed: %v", err)
+			s.releaseAPIKey(key, charge)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reach API"})
+			return
+		}
+
+		if !isKeyError(resp.StatusCode) {
+			break
+		}
+
+		// The upstream did not serve the request, so give the credits back
+		s.logger.Warnf("API key %d rejected with status %d", key.ID, resp.StatusCode)
+		s.releaseAPIKey(key, charge)
+		s.handleKeyError(key, resp.StatusCode)
+		if attempt >= s.cfg.MaxAttempts {
+			break
+		}
+
+		// Retry on another key, or return this response if there is none
+		criteria.ExcludeIDs = append(criteria.ExcludeIDs, key.ID)
+		next, err := s.acquireAPIKey(criteria, charge)
+		if err != nil {
+			s.logger.Debugf("No other API key to fail over to: %v", err)
+			break
+		}
+		s.logFailover(entry, key, resp.StatusCode, attemptStart)
+		resp.Body.Close()
+		key = next
+	}
+	defer resp.Body.Close()
+
+	// Credits are only spent if the upstream accepted the key
+	entry.KeyID = key.ID
+	if !isKeyError(resp.StatusCode) {
+		entry.QueryCredits = charge.Query
+		entry.ScanCredits = charge.Scan
+	}
+
+	s.writeResponse(c, resp, cacheKey, cacheTTL)
+}
+
+// writeResponse copies an API response to the client, caching it under
+// cacheKey if set and the request succeeded
+func (s *Server) writeResponse(c *gin.Context, resp *http.Response, cacheKey string, cacheTTL time.Duration) {
+	// Buffer and cache successful responses
+	if cacheKey != "" && resp.StatusCode == http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			s.logger.Errorf("Failed to read API response: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read API response"})
+			return
+		}
+		cached := &cache.Entry{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header.Clone(),
+			Body:       body,
+		}
+		if err := s.cache.Set(cacheKey, cached, cacheTTL); err != nil {
+			s.logger.Errorf("Failed to write cache: %v", err)
+		}
+		c.Writer.Header().Set("X-Shodone-Cache", "MISS")
+		writeCachedResponse(c, cached)
+		return
+	}
+
+	// Copy headers from API response
+	for k, v := range resp.Header {
+		c.Writer.Header()[k] = v
+	}
+	c.Writer.WriteHeader(resp.StatusCode)
+
+	// Copy response body
+	io.Copy(c.Writer, resp.Body)
+}
+
+// logRequest completes a request log entry from the response and stores it
+func (s *Server) logRequest(c *gin.Context, entry *storage.RequestLog) {
+	entry.StatusCode = c.Writer.Status()
+	entry.Bytes = max(c.Writer.Size(), 0)
+	entry.LatencyMs = time.Since(entry.Timestamp).Milliseconds()
+	if err := s.db.LogRequest(entry); err != nil {
+		s.logger.Errorf("Failed to log request: %v", err)
+	}
+}
+
+// logFailover logs the attempt of a request rejected by key and retried
+// with another key, so the rejection counts against the key
+func (s *Server) logFailover(entry *storage.RequestLog, key *storage.APIKey, statusCode int, start time.Time) {
+	attempt := *entry
+	attempt.Timestamp = start
+	attempt.StatusCode = statusCode
+	attempt.KeyID = key.ID
+	attempt.LatencyMs = time.Since(start).Milliseconds()
+	attempt.FailedOver = true
+	if err := s.db.LogRequest(&attempt); err != nil {
+		s.logger.Errorf("Failed to log request: %v", err)
+	}
+}
+
+// clientIdentity returns the client named by the X-Shodone-Client header,
+// or the client IP
+func clientIdentity(c *gin.Context) string {
+	if client := c.GetHeader(clientHeader); client != "" {
+		return client
+	}
+	return c.ClientIP()
+}
+
+// acquireAPIKey gets an available API key matching criteria and charges it
+// Usage is charged before making the request, in the same transaction
+// as the selection, which prevents simultaneous requests from exceeding quota
+func (s *Server) acquireAPIKey(criteria storage.KeyCriteria, charge cost.Cost) (*storage.APIKey, error) {
+	return s.db.ReserveAPIKey(criteria, charge.Query, charge.Scan)
+}
+
+// strategyFor returns the key selection strategy of a pool
+func (s *Server) strategyFor(pool string) storage.Strategy {
+	name := s.cfg.KeyStrategy
+	if poolStrategy, ok := s.cfg.PoolStrategies[storage.NormalizeTag(pool)]; ok && pool != "" {
+		name = poolStrategy
+	}
+	strategy, err := storage.StrategyByName(name)
+	if err != nil {
+		strategy, _ = storage.StrategyByName(storage.StrategyBalanced)
+	}
+	return strategy
+}
+
+// releaseAPIKey restores the usage charged by acquireAPIKey
+func (s *Server) releaseAPIKey(key *storage.APIKey, charge cost.Cost) {
+	if err := s.db.RefundAPIKey(key.ID, charge.Query, charge.Scan); err != nil {
+		s.logger.Errorf("Failed to restore API key usage: %v", err)
+	}
+}
+
+// handleKeyError updates the state of a key rejected by the upstream
+// Forbidden only means the key can't use this endpoint, so it stays active
+func (s *Server) handleKeyError(key *storage.APIKey, statusCode int) {
+	var state, reason string
+	var until time.Time
+	switch statusCode {
+	case http.StatusUnauthorized:
+		state, reason = storage.StateInvalid, "upstream returned 401 Unauthorized"
+	case http.StatusPaymentRequired:
+		state, reason = storage.StateExhausted, "upstream returned 402 Payment Required"
+		until = exhaustedUntil(key)
+	case http.StatusTooManyRequests:
+		state, reason = storage.StateRateLimited, "upstream returned 429 Too Many Requests"
+		until = time.Now().Add(time.Duration(s.cfg.RateLimitCooldown) * time.Second)
+	default:
+		return
+	}
+	if err := s.db.SetAPIKeyState(key.ID, state, reason, until); err != nil {
+		s.logger.Errorf("Failed to update API key state: %v", err)
+	}
+}
+
+// exhaustedUntil returns when an exhausted key gets its credits back,
+// zero if its reset rule has no schedule
+func exhaustedUntil(key *storage.APIKey) time.Time {
+	return key.NextReset(time.Now())
+}
+
+// isKeyError reports whether the status code means the upstream rejected
+// the key (invalid, out of credits, forbidden or rate-limited)
+func isKeyError(statusCode int) bool {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusPaymentRequired,
+		http.StatusForbidden, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// writeCachedResponse writes a cached response to the client
+func writeCachedResponse(c *gin.Context, entry *cache.Entry) {
+	for k, v := range entry.Header {
+		c.Writer.Header()[k] = v
+	}
+	if c.Writer.Header().Get("X-Shodone-Cache") == "" {
+		c.Writer.Header().Set("X-Shodone-Cache", "HIT")
+	}
+	c.Writer.WriteHeader(entry.StatusCode)
+	c.Writer.Write(entry.Body)
+}
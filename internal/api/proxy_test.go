@@ -0,0 +1,244 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"shodone/internal/cache"
+	"shodone/internal/config"
+	"shodone/internal/cost"
+	"shodone/internal/plan"
+	"shodone/internal/storage"
+)
+
+// fakeUpstream answers every request with the status set for its key,
+// 200 for keys without one, and counts the requests of each key
+type fakeUpstream struct {
+	mu       sync.Mutex
+	statuses map[string]int
+	hits     map[string]int
+}
+
+func (u *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	u.mu.Lock()
+	u.hits[key]++
+	status, ok := u.statuses[key]
+	u.mu.Unlock()
+	if !ok {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, `{"key": "`+key+`"}`)
+}
+
+// newTestServer returns a server proxying to upstream, with a fresh
+// database and the default cost rules, without cache
+func newTestServer(t *testing.T, upstream http.Handler) (*Server, *storage.DB) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	api := httptest.NewServer(upstream)
+	t.Cleanup(api.Close)
+
+	db, err := storage.New(filepath.Join(t.TempDir(), "shodone.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cfg := &config.Config{
+		APIHost:           api.URL,
+		DefaultQuotaLimit: config.DefaultQuotaLimit,
+		CostRules:         cost.DefaultRules(),
+		MaxAttempts:       config.DefaultMaxAttempts,
+		RateLimitCooldown: config.DefaultRateLimitCooldown,
+		KeyStrategy:       config.DefaultKeyStrategy,
+		ClientKeyMode:     config.ClientKeyModeStrip,
+		PlanCapabilities:  plan.DefaultCapabilities(),
+		CacheBackend:      config.CacheBackendNone,
+		RefreshTimeout:    config.DefaultRefreshTimeout,
+	}
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	return NewServer(cfg, db, logger), db
+}
+
+// serve sends a request to the server and returns the recorded response
+func serve(s *Server, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(method, target, body))
+	return rec
+}
+
+// addTestKeys adds keys with a quota of 10 and returns their IDs
+func addTestKeys(t *testing.T, db *storage.DB, keys ...string) []int {
+	t.Helper()
+	var ids []int
+	for _, key := range keys {
+		id, err := db.AddAPIKey(storage.NewAPIKey{Key: key, QuotaLimit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestProxyFailover(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		wantState string
+		wantUntil time.Duration // Expected state_until from now, 0 if none
+	}{
+		{"unauthorized", http.StatusUnauthorized, storage.StateInvalid, 0},
+		{"payment required", http.StatusPaymentRequired, storage.StateExhausted, -1},
+		{"rate-limited", http.StatusTooManyRequests, storage.StateRateLimited, config.DefaultRateLimitCooldown * time.Second},
+		{"forbidden", http.StatusForbidden, storage.StateActive, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &fakeUpstream{statuses: map[string]int{"FIRSTKEY": tt.status}, hits: map[string]int{}}
+			s, db := newTestServer(t, upstream)
+			ids := addTestKeys(t, db, "FIRSTKEY", "SECONDKEY")
+
+			rec := serve(s, http.MethodGet, "/api/dns/domain/example.com", nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200 from the second key: %s", rec.Code, rec.Body)
+			}
+			if upstream.hits["FIRSTKEY"] != 1 || upstream.hits["SECONDKEY"] != 1 {
+				t.Errorf("upstream hits = %v, want one per key", upstream.hits)
+			}
+
+			first, _ := db.GetAPIKey(ids[0])
+			if first.State != tt.wantState {
+				t.Errorf("rejected key state = %s, want %s", first.State, tt.wantState)
+			}
+			switch {
+			case tt.wantUntil > 0:
+				if until := time.Until(first.StateUntil); until <= 0 || until > tt.wantUntil {
+					t.Errorf("rejected key state_until in %v, want within %v", until, tt.wantUntil)
+				}
+			case tt.wantUntil < 0:
+				if !first.StateUntil.Equal(first.NextReset(time.Now())) {
+					t.Errorf("rejected key state_until = %v, want its next reset", first.StateUntil)
+				}
+			}
+			if first.QuotaUsed != 0 {
+				t.Errorf("rejected key used %d credits, want the charge refunded", first.QuotaUsed)
+			}
+			second, _ := db.GetAPIKey(ids[1])
+			if second.QuotaUsed != 1 {
+				t.Errorf("serving key used %d credits, want 1", second.QuotaUsed)
+			}
+
+			logs, total, err := db.GetRequestLogs(storage.LogFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 2 {
+				t.Fatalf("logged %d requests, want the failed over attempt and the answer", total)
+			}
+			answer, attempt := logs[0], logs[1]
+			if !attempt.FailedOver || attempt.KeyID != ids[0] || attempt.StatusCode != tt.status || attempt.QueryCredits != 0 {
+				t.Errorf("failed over attempt logged as %+v", attempt)
+			}
+			if answer.FailedOver || answer.KeyID != ids[1] || answer.StatusCode != http.StatusOK || answer.QueryCredits != 1 {
+				t.Errorf("answer logged as %+v", answer)
+			}
+		})
+	}
+}
+
+func TestProxyFailoverMaxAttempts(t *testing.T) {
+	upstream := &fakeUpstream{
+		statuses: map[string]int{"FIRSTKEY": 401, "SECONDKEY": 401, "THIRDKEY": 401},
+		hits:     map[string]int{},
+	}
+	s, db := newTestServer(t, upstream)
+	s.cfg.MaxAttempts = 2
+	ids := addTestKeys(t, db, "FIRSTKEY", "SECONDKEY", "THIRDKEY")
+
+	rec := serve(s, http.MethodGet, "/api/dns/domain/example.com", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want the last rejection", rec.Code)
+	}
+	if upstream.hits["FIRSTKEY"] != 1 || upstream.hits["SECONDKEY"] != 1 || upstream.hits["THIRDKEY"] != 0 {
+		t.Errorf("upstream hits = %v, want the first two keys only", upstream.hits)
+	}
+	for i, id := range ids {
+		key, _ := db.GetAPIKey(id)
+		wantState := storage.StateInvalid
+		if i == 2 {
+			wantState = storage.StateActive
+		}
+		if key.State != wantState || key.QuotaUsed != 0 {
+			t.Errorf("key %d = %s with %d credits used, want %s with none", id, key.State, key.QuotaUsed, wantState)
+		}
+	}
+
+	logs, total, err := db.GetRequestLogs(storage.LogFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || !logs[1].FailedOver || logs[0].FailedOver || logs[0].KeyID != ids[1] || logs[0].QueryCredits != 0 {
+		t.Errorf("logged %d requests, want a failed over attempt and the rejected answer: %+v", total, logs)
+	}
+}
+
+func TestProxyFailoverNoOtherKey(t *testing.T) {
+	upstream := &fakeUpstream{statuses: map[string]int{"FIRSTKEY": 429}, hits: map[string]int{}}
+	s, db := newTestServer(t, upstream)
+	ids := addTestKeys(t, db, "FIRSTKEY")
+
+	rec := serve(s, http.MethodGet, "/api/dns/domain/example.com", nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want the rejection passed through", rec.Code)
+	}
+	key, _ := db.GetAPIKey(ids[0])
+	if key.State != storage.StateRateLimited || key.QuotaUsed != 0 {
+		t.Errorf("key = %s with %d credits used, want rate_limited with none", key.State, key.QuotaUsed)
+	}
+	if _, total, _ := db.GetRequestLogs(storage.LogFilter{}); total != 1 {
+		t.Errorf("logged %d requests, want only the answer", total)
+	}
+}
+
+func TestProxyCache(t *testing.T) {
+	upstream := &fakeUpstream{statuses: map[string]int{}, hits: map[string]int{}}
+	s, db := newTestServer(t, upstream)
+	s.cache = cache.NewMemory(10)
+	s.cfg.CacheTTL = 3600
+	s.cfg.CacheRouteTTLs = map[string]int{"/dns/domain/uncached": 0}
+	addTestKeys(t, db, "FIRSTKEY")
+
+	first := serve(s, http.MethodGet, "/api/dns/domain/example.com?key=CLIENTA", nil)
+	second := serve(s, http.MethodGet, "/api/dns/domain/example.com?key=CLIENTB", nil)
+	if first.Header().Get("X-Shodone-Cache") != "MISS" || second.Header().Get("X-Shodone-Cache") != "HIT" {
+		t.Errorf("cache headers = %q then %q, want MISS then HIT whatever the client key",
+			first.Header().Get("X-Shodone-Cache"), second.Header().Get("X-Shodone-Cache"))
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("cached body = %q, want %q", second.Body, first.Body)
+	}
+	if upstream.hits["FIRSTKEY"] != 1 {
+		t.Errorf("upstream hit %d times, want once", upstream.hits["FIRSTKEY"])
+	}
+
+	// A TTL of 0 disables caching the route
+	serve(s, http.MethodGet, "/api/dns/domain/uncached", nil)
+	rec := serve(s, http.MethodGet, "/api/dns/domain/uncached", nil)
+	if rec.Header().Get("X-Shodone-Cache") != "" || upstream.hits["FIRSTKEY"] != 3 {
+		t.Errorf("uncached route answered with %q after %d upstream hits, want no cache and 3 hits",
+			rec.Header().Get("X-Shodone-Cache"), upstream.hits["FIRSTKEY"])
+	}
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"shodone/internal/client"
+	"shodone/internal/storage"
+)
+
+// refreshResult reports the outcome of refreshing one key
+type refreshResult struct {
+	ID           int    `json:"id"`
+	Key          string `json:"key"`
+	Valid        bool   `json:"valid"`
+	QueryCredits int    `json:"query_credits"`
+	ScanCredits  int    `json:"scan_credits"`
+	Plan         string `json:"plan"`
+	Error        string `json:"error,omitempty"`
+}
+
+// refreshSingleAPIKey refreshes one key
+// this is a helper function to refreshAPIKey and refreshAPIKeys
+func (s *Server) refreshSingleAPIKey(ctx context.Context, key *storage.APIKey) (*refreshResult, error) {
+	result := &refreshResult{
+		ID:  key.ID,
+		Key: maskAPIKey(key.Key),
+	}
+
+	// Check if key is valid and get remaining credits
+	info, checkErr := s.client.ValidateAPIKey(ctx, key.Key, 0)
+	result.Valid = checkErr == nil
+	if info != nil {
+		result.QueryCredits = info.QueryCredits
+		result.ScanCredits = info.ScanCredits
+		result.Plan = info.Plan
+		if err := s.detectReset(key, info); err != nil {
+			return result, err
+		}
+		if err := s.db.StoreAPIKeyInfo(key.ID, key.QuotaLimit, info); err != nil {
+			return result, err
+		}
+	}
+	if err := s.updateCheckedState(key, checkErr); err != nil {
+		return result, fmt.Errorf("failed to update API key state: %v", err)
+	}
+	if checkErr != nil && !client.IsInvalidKey(checkErr) {
+		return result, fmt.Errorf("failed to check API key %d: %v", key.ID, checkErr)
+	}
+	return result, nil
+}
+
+// updateCheckedState moves a key to the state matching the error of
+// client.ValidateAPIKey, nil for a valid key
+// Keys disabled by an admin stay disabled, and a check that failed
+// leaves the state alone unless the API rate-limited a usable key
+func (s *Server) updateCheckedState(key *storage.APIKey, checkErr error) error {
+	switch {
+	case key.State == storage.StateDisabled:
+		return nil
+	case checkErr == nil:
+		if key.State == storage.StateActive {
+			return nil
+		}
+		return s.db.SetAPIKeyState(key.ID, storage.StateActive, "check succeeded", time.Time{})
+	case errors.Is(checkErr, client.ErrKeyRejected):
+		return s.db.SetAPIKeyState(key.ID, storage.StateInvalid, "check rejected the key", time.Time{})
+	case errors.Is(checkErr, client.ErrNoCredits):
+		return s.db.SetAPIKeyState(key.ID, storage.StateExhausted, "check found no credits left", exhaustedUntil(key))
+	case client.IsRateLimited(checkErr) && (key.State == storage.StateActive || key.State == storage.StateRateLimited):
+		until := time.Now().Add(time.Duration(s.cfg.RateLimitCooldown) * time.Second)
+		return s.db.SetAPIKeyState(key.ID, storage.StateRateLimited, "check returned 429 Too Many Requests", until)
+	}
+	return nil
+}
+
+// detectReset records a quota reset of a key whose reset rule is auto
+// when /api-info reports more credits than the key had left
+func (s *Server) detectReset(key *storage.APIKey, info *client.KeyInfo) error {
+	rule, err := storage.ParseResetRule(key.ResetRule)
+	if err != nil || rule.Kind != storage.ResetAuto {
+		return nil
+	}
+	if info.QueryCredits <= key.QuotaLimit-key.QuotaUsed {
+		return nil
+	}
+	s.logger.Infof("Detected quota reset of API key %d", key.ID)
+	if err := s.db.RecordAPIKeyReset(key.ID, time.Now()); err != nil {
+		return fmt.Errorf("failed to record API key reset: %v", err)
+	}
+	return nil
+}
+
+// refreshAPIKey checks one API key and updates its status
+func (s *Server) refreshAPIKey(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
+		return
+	}
+	// Get key
+	key, err := s.db.GetAPIKey(id)
+	if err != nil {
+		s.logger.Errorf("Failed to get API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API key"})
+		return
+	}
+
+	results := s.refreshKeys(c.Request.Context(), []*storage.APIKey{key})
+	if results[0].Error != "" {
+		c.JSON(http.StatusBadGateway, results[0])
+		return
+	}
+	c.JSON(http.StatusOK, results[0])
+}
+
+// refreshAPIKeys checks all API keys and updates their status
+func (s *Server) refreshAPIKeys(c *gin.Context) {
+	keys, err := s.db.GetAllAPIKeys()
+	if err != nil {
+		s.logger.Errorf("Failed to get API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API keys"})
+		return
+	}
+
+	results := s.refreshKeys(c.Request.Context(), keys)
+	c.JSON(http.StatusOK, gin.H{
+		"status":       "ok",
+		"total_keys":   len(keys),
+		"updated_keys": countRefreshed(results),
+		"keys":         results,
+	})
+}
+
+// refreshKeys refreshes the given keys in a bounded worker pool,
+// each check bounded by the refresh timeout and ctx
+// Results are returned in the order of keys, and the keys left once ctx
+// is done are not checked but reported with its error
+func (s *Server) refreshKeys(ctx context.Context, keys []*storage.APIKey) []*refreshResult {
+	results := make([]*refreshResult, len(keys))
+	workers := s.cfg.RefreshConcurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	timeout := time.Duration(s.cfg.RefreshTimeout) * time.Second
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(keys); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = s.refreshWithTimeout(ctx, keys[i], timeout)
+			}
+		}()
+	}
+	for i := range keys {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// refreshWithTimeout refreshes one key, giving up after timeout if positive
+// or when ctx is done
+func (s *Server) refreshWithTimeout(ctx context.Context, key *storage.APIKey, timeout time.Duration) *refreshResult {
+	if err := ctx.Err(); err != nil {
+		return &refreshResult{ID: key.ID, Key: maskAPIKey(key.Key), Error: err.Error()}
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	result, err := s.refreshSingleAPIKey(ctx, key)
+	if err != nil {
+		s.logger.Errorf("Failed to refresh API key %d: %v", key.ID, err)
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// countRefreshed returns how many keys were refreshed without error
+func countRefreshed(results []*refreshResult) int {
+	var count int
+	for _, result := range results {
+		if result.Error == "" {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// StartScheduler starts the background jobs of the server:
+// resetting expired quotas, re-checking keys against the API,
+// probing unusable keys, warning before the pool runs dry and
+// pruning the response cache
+// A job whose interval is not positive is disabled
+func (s *Server) StartScheduler() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopScheduler = cancel
+
+	s.runEvery(ctx, "quota reset", time.Duration(s.cfg.QuotaResetInterval)*time.Second, s.resetExpiredQuotas)
+	s.runEvery(ctx, "key check", time.Duration(s.cfg.KeyCheckInterval)*time.Second, func() { s.checkAllKeys(ctx) })
+	s.runEvery(ctx, "key probe", time.Duration(s.cfg.ProbeInterval)*time.Second, func() { s.probeKeys(ctx) })
+	s.runEvery(ctx, "pool forecast", time.Duration(s.cfg.ForecastInterval)*time.Second, s.checkForecast)
+	if s.cache != nil {
+		s.runEvery(ctx, "cache prune", time.Duration(s.cfg.CachePruneInterval)*time.Second, s.pruneCache)
+	}
+}
+
+// StopScheduler stops the background jobs and waits for running ones to finish
+// Running key checks are cancelled
+func (s *Server) StopScheduler() {
+	if s.stopScheduler == nil {
+		return
+	}
+	s.stopScheduler()
+	s.schedulerWG.Wait()
+	s.stopScheduler = nil
+}
+
+// runEvery runs job every interval until ctx is done
+func (s *Server) runEvery(ctx context.Context, name string, interval time.Duration, job func()) {
+	if interval <= 0 {
+		s.logger.Infof("Background job %s disabled", name)
+		return
+	}
+
+	s.logger.Infof("Background job %s runs every %s", name, interval)
+	s.schedulerWG.Add(1)
+	go func() {
+		defer s.schedulerWG.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// Both cases may be ready, so do not start a job once stopped
+				if ctx.Err() != nil {
+					return
+				}
+				job()
+			}
+		}
+	}()
+}
+
+// resetExpiredQuotas resets the quota of every key whose refresh time has passed
+func (s *Server) resetExpiredQuotas() {
+	ids, err := s.db.ResetExpiredQuotas(time.Now())
+	if err != nil {
+		s.logger.Errorf("Failed to reset expired quotas: %v", err)
+		return
+	}
+	if len(ids) > 0 {
+		s.logger.Infof("Reset quota of API keys %v", ids)
+	}
+}
+
+// checkAllKeys re-checks every key against the API until ctx is done
+func (s *Server) checkAllKeys(ctx context.Context) {
+	keys, err := s.db.GetAllAPIKeys()
+	if err != nil {
+		s.logger.Errorf("Failed to get API keys: %v", err)
+		return
+	}
+	results := s.refreshKeys(ctx, keys)
+	if ctx.Err() != nil {
+		s.logger.Infof("Key check cancelled after %d/%d API keys", countRefreshed(results), len(keys))
+		return
+	}
+	s.logger.Infof("Checked %d/%d API keys", countRefreshed(results), len(keys))
+}
+
+// probeKeys re-checks the invalid and exhausted keys due for a probe,
+// reactivating the ones valid with credits again and backing off the others
+// Probes cancelled with ctx are not counted as failed
+func (s *Server) probeKeys(ctx context.Context) {
+	now := time.Now()
+	keys, err := s.db.GetAPIKeysToProbe(now)
+	if err != nil {
+		s.logger.Errorf("Failed to get API keys to probe: %v", err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	results := s.refreshKeys(ctx, keys)
+	var reactivated []int
+	for i, result := range results {
+		key := keys[i]
+		if result.Error == "" && result.Valid {
+			reactivated = append(reactivated, key.ID)
+			continue
+		}
+		if ctx.Err() != nil {
+			continue
+		}
+		attempts := key.ProbeAttempts + 1
+		next := now.Add(s.probeBackoff(attempts))
+		if err := s.db.ScheduleAPIKeyProbe(key.ID, attempts, next); err != nil {
+			s.logger.Errorf("Failed to schedule probe of API key %d: %v", key.ID, err)
+		}
+	}
+	s.logger.Infof("Probed %d API keys, reactivated %v", len(keys), reactivated)
+}
+
+// checkForecast warns when the pool is projected to run dry before the next reset
+func (s *Server) checkForecast() {
+	pool, _, err := s.forecast("", time.Now())
+	if err != nil {
+		s.logger.Errorf("Failed to forecast API key usage: %v", err)
+		return
+	}
+	if pool.RunsOutBeforeReset {
+		s.logger.Warnf(
+			"API key pool projected to run dry at %s, before the next reset: %d query credits left, spending %.1f a day",
+			pool.RunsOutAt.Format(time.RFC3339), pool.Remaining, pool.SpendPerDay,
+		)
+	}
+}
+
+// pruneCache removes the expired responses from the cache
+func (s *Server) pruneCache() {
+	removed, err := s.cache.Prune()
+	if err != nil {
+		s.logger.Errorf("Failed to prune cache: %v", err)
+		return
+	}
+	if removed > 0 {
+		s.logger.Debugf("Pruned %d cached responses", removed)
+	}
+}
+
+// probeBackoff returns the wait before the next probe after attempts failed ones
+// The wait doubles with each attempt, up to the max if positive, and stops
+// doubling before it would overflow
+func (s *Server) probeBackoff(attempts int) time.Duration {
+	backoff := time.Duration(s.cfg.ProbeBackoff) * time.Second
+	max := time.Duration(s.cfg.ProbeBackoffMax) * time.Second
+	for i := 1; i < attempts; i++ {
+		if backoff <= 0 || backoff > math.MaxInt64/2 || (max > 0 && backoff >= max) {
+			break
+		}
+		backoff *= 2
+	}
+	if max > 0 && backoff > max {
+		backoff = max
+	}
+	return backoff
+}
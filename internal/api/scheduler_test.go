@@ -0,0 +1,42 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"shodone/internal/config"
+)
+
+func TestProbeBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		backoff  int
+		max      int
+		attempts int
+		want     time.Duration
+	}{
+		{"no attempt yet", 600, 86400, 0, 10 * time.Minute},
+		{"first attempt", 600, 86400, 1, 10 * time.Minute},
+		{"second attempt doubles", 600, 86400, 2, 20 * time.Minute},
+		{"fifth attempt", 600, 86400, 5, 160 * time.Minute},
+		{"capped at the max", 600, 86400, 10, 24 * time.Hour},
+		{"far past the max", 600, 86400, 1000, 24 * time.Hour},
+		{"max below the backoff", 600, 60, 1, time.Minute},
+		{"uncapped first attempt", 600, 0, 1, 10 * time.Minute},
+		{"uncapped keeps doubling", 600, 0, 10, 512 * 10 * time.Minute},
+		{"uncapped does not overflow", 600, 0, 1000, 10 * time.Minute << 23},
+		{"zero backoff", 0, 0, 5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{cfg: &config.Config{ProbeBackoff: tt.backoff, ProbeBackoffMax: tt.max}}
+			got := s.probeBackoff(tt.attempts)
+			if got != tt.want {
+				t.Errorf("probeBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+			}
+			if got < 0 {
+				t.Errorf("probeBackoff(%d) = %v overflowed", tt.attempts, got)
+			}
+		})
+	}
+}
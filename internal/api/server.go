@@ -2,31 +2,41 @@ package api
 
 import (
 	"context"
+	"database/sql"
 	// "encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"shodone/internal/cache"
 	"shodone/internal/client"
 	"shodone/internal/config"
+	"shodone/internal/cost"
+	"shodone/internal/keyio"
 	"shodone/internal/storage"
 )
 
 // Server represents the API server
 type Server struct {
-	router   *gin.Engine
-	client   *client.Client
-	db       *storage.DB
-	cfg      *config.Config
-	logger   *log.Logger
-	server   *http.Server
-	keyMutex sync.Mutex
+	router *gin.Engine
+	client *client.Client
+	cache  cache.Cache
+	cost   *cost.Model
+	db     *storage.DB
+	cfg    *config.Config
+	logger *log.Logger
+	server *http.Server
+
+	// Background jobs
+	stopScheduler context.CancelFunc
+	schedulerWG   sync.WaitGroup
 }
 
 // NewServer creates a new API server
@@ -34,14 +44,52 @@ func NewServer(cfg *config.Config, db *storage.DB, logger *log.Logger) *Server {
 	// Create API client
 	apiClient := client.New(cfg.APIHost)
 
+	// Create response cache
+	var responseCache cache.Cache
+	switch cfg.CacheBackend {
+	case config.CacheBackendMemory:
+		responseCache = cache.NewMemory(cfg.CacheMaxEntries)
+	case config.CacheBackendSQLite:
+		responseCache = cache.NewSQLite(db, cfg.CacheMaxEntries)
+	case config.CacheBackendNone, "":
+	default:
+		logger.Warnf("Unknown cache backend %q, caching disabled", cfg.CacheBackend)
+	}
+
 	// Create server
 	server := &Server{
-		router:   gin.New(),
-		client:   apiClient,
-		db:       db,
-		cfg:      cfg,
-		logger:   logger,
-		keyMutex: sync.Mutex{},
+		router: gin.New(),
+		client: apiClient,
+		cache:  responseCache,
+		cost:   cost.New(cfg.CostRules, cfg.CostPerRequest),
+		db:     db,
+		cfg:    cfg,
+		logger: logger,
+	}
+
+	// Check the key selection strategies
+	if _, err := storage.StrategyByName(cfg.KeyStrategy); err != nil {
+		logger.Warnf("%v, using %s", err, storage.StrategyBalanced)
+	}
+	// Pools are matched like tags, so normalize them the same way
+	poolStrategies := make(map[string]string, len(cfg.PoolStrategies))
+	for pool, name := range cfg.PoolStrategies {
+		if _, err := storage.StrategyByName(name); err != nil {
+			logger.Warnf("Pool %s: %v, using %s", pool, err, storage.StrategyBalanced)
+		}
+		poolStrategies[storage.NormalizeTag(pool)] = name
+	}
+	cfg.PoolStrategies = poolStrategies
+
+	// Check the client key mode
+	switch cfg.ClientKeyMode {
+	case config.ClientKeyModeStrip, config.ClientKeyModePassthrough, "":
+	case config.ClientKeyModeToken:
+		if len(cfg.AccessTokens) == 0 {
+			logger.Warn("Client key mode token without access tokens, every proxied request is rejected")
+		}
+	default:
+		logger.Warnf("Unknown client key mode %q, using %s", cfg.ClientKeyMode, config.ClientKeyModeStrip)
 	}
 
 	// Setup routes
@@ -69,10 +117,41 @@ func (s *Server) setupRoutes() {
 	{
 		keyGroup.GET("/", s.getAllAPIKeys)
 		keyGroup.POST("/", s.addAPIKey)
+		keyGroup.POST("/import", s.importAPIKeys)
+		keyGroup.GET("/export", s.exportAPIKeys)
+		keyGroup.GET("/expiring", s.getExpiringAPIKeys)
+		keyGroup.GET("/forecast", s.getForecast)
 		keyGroup.GET("/:id", s.getAPIKey)
 		keyGroup.DELETE("/:id", s.deleteAPIKey)
+		keyGroup.POST("/:id/restore", s.restoreAPIKey)
+		keyGroup.DELETE("/:id/purge", s.purgeAPIKey)
 		keyGroup.PUT("/:id", s.updateAPIKey)
+		keyGroup.PATCH("/:id", s.updateAPIKey)
 		keyGroup.GET("/refresh", s.refreshAPIKeys)
+		keyGroup.GET("/:id/refresh", s.refreshAPIKey)
+		keyGroup.GET("/:id/events", s.getAPIKeyEvents)
+	}
+
+	// Response cache management
+	cacheGroup := s.router.Group("/cache")
+	{
+		cacheGroup.DELETE("/", s.purgeCache)
+	}
+
+	// Request log
+	logGroup := s.router.Group("/logs")
+	{
+		logGroup.GET("/", s.getLogs)
+	}
+
+	// Usage statistics from the request log
+	statsGroup := s.router.Group("/stats")
+	{
+		statsGroup.GET("/keys", s.getStats(storage.StatsByKey))
+		statsGroup.GET("/days", s.getStats(storage.StatsByDay))
+		statsGroup.GET("/endpoints", s.getStats(storage.StatsByEndpoint))
+		statsGroup.GET("/clients", s.getStats(storage.StatsByClient))
+		statsGroup.GET("/queries", s.getStats(storage.StatsByQuery))
 	}
 
 	// API proxy endpoint - match any path under /api
@@ -92,8 +171,10 @@ func (s *Server) Start() error {
 	return s.server.ListenAndServe()
 }
 
-// Stop stops the API server
+// Stop stops the API server and its background jobs
 func (s *Server) Stop() error {
+	s.StopScheduler()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	return s.server.Shutdown(ctx)
@@ -102,10 +183,33 @@ func (s *Server) Stop() error {
 // getConfig returns the current configuration
 func (s *Server) getConfig(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
-		"api_host":            s.cfg.APIHost,
-		"port":                s.cfg.Port,
-		"default_quota_limit": s.cfg.DefaultQuotaLimit,
-		"cost_per_request":    s.cfg.CostPerRequest,
+		"api_host":             s.cfg.APIHost,
+		"port":                 s.cfg.Port,
+		"default_quota_limit":  s.cfg.DefaultQuotaLimit,
+		"cost_per_request":     s.cfg.CostPerRequest,
+		"cost_rules":           s.cfg.CostRules,
+		"max_attempts":         s.cfg.MaxAttempts,
+		"rate_limit_cooldown":  s.cfg.RateLimitCooldown,
+		"discover_keys":        s.cfg.DiscoverKeys,
+		"key_strategy":         s.cfg.KeyStrategy,
+		"pool_strategies":      s.cfg.PoolStrategies,
+		"client_key_mode":      s.cfg.ClientKeyMode,
+		"access_tokens":        len(s.cfg.AccessTokens),
+		"plan_capabilities":    s.cfg.PlanCapabilities,
+		"quota_reset_interval": s.cfg.QuotaResetInterval,
+		"key_check_interval":   s.cfg.KeyCheckInterval,
+		"cache_prune_interval": s.cfg.CachePruneInterval,
+		"probe_interval":       s.cfg.ProbeInterval,
+		"probe_backoff":        s.cfg.ProbeBackoff,
+		"probe_backoff_max":    s.cfg.ProbeBackoffMax,
+		"forecast_window":      s.cfg.ForecastWindow,
+		"forecast_interval":    s.cfg.ForecastInterval,
+		"refresh_concurrency":  s.cfg.RefreshConcurrency,
+		"refresh_timeout":      s.cfg.RefreshTimeout,
+		"cache_backend":        s.cfg.CacheBackend,
+		"cache_ttl":            s.cfg.CacheTTL,
+		"cache_max_entries":    s.cfg.CacheMaxEntries,
+		"cache_route_ttls":     s.cfg.CacheRouteTTLs,
 	})
 }
 
@@ -133,21 +237,27 @@ func (s *Server) setAPIHost(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "api_host": req.APIHost})
 }
 
-// getAllAPIKeys returns all API keys
+// getAllAPIKeys returns all API keys, or the keys of the `pool` query parameter
 func (s *Server) getAllAPIKeys(c *gin.Context) {
-	keys, err := s.db.GetAllAPIKeys()
+	keys, err := s.listedAPIKeys(c)
 	if err != nil {
 		s.logger.Errorf("Failed to get API keys: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API keys"})
 		return
 	}
 
-	// Mask the actual key values for security
+	pool := c.Query("pool")
+	filtered := make([]*storage.APIKey, 0, len(keys))
 	for _, key := range keys {
+		if pool != "" && !key.HasTag(pool) {
+			continue
+		}
+		// Mask the actual key values for security
 		key.Key = maskAPIKey(key.Key)
+		filtered = append(filtered, key)
 	}
 
-	c.JSON(http.StatusOK, keys)
+	c.JSON(http.StatusOK, filtered)
 }
 
 // getAPIKey returns a specific API key
@@ -173,46 +283,108 @@ func (s *Server) getAPIKey(c *gin.Context) {
 }
 
 // addAPIKey adds a new API key
+// The key is checked against /api-info first: invalid keys are rejected,
+// unless allow_invalid is set, in which case they are stored inactive
 func (s *Server) addAPIKey(c *gin.Context) {
 	var req struct {
-		Key         string    `json:"key" binding:"required"`
-		QuotaLimit  int       `json:"quota_limit"`
-		RefreshesAt time.Time `json:"refreshes_at"`
+		Key          string    `json:"key" binding:"required"`
+		QuotaLimit   int       `json:"quota_limit"`
+		RefreshesAt  time.Time `json:"refreshes_at"`
+		ResetRule    string    `json:"reset_rule"`
+		Label        string    `json:"label"`
+		Owner        string    `json:"owner"`
+		Notes        string    `json:"notes"`
+		ExpiresAt    time.Time `json:"expires_at"`
+		Tags         []string  `json:"tags"`
+		AllowInvalid bool      `json:"allow_invalid"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	req.Key = strings.TrimSpace(req.Key)
+	if req.Key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API key must not be empty"})
+		return
+	}
+	if _, err := storage.ParseResetRule(req.ResetRule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	// If quota limit is not provided, use the default
-	if req.QuotaLimit <= 0 {
-		req.QuotaLimit = s.cfg.DefaultQuotaLimit
+	// Skip the check of keys already stored
+	exists, err := s.db.HasAPIKey(req.Key)
+	if err != nil {
+		s.logger.Errorf("Failed to look up API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add API key"})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "API key already exists"})
+		return
+	}
+
+	// Validate the key against the API
+	info, checkErr := s.client.ValidateAPIKey(c.Request.Context(), req.Key, time.Duration(s.cfg.RefreshTimeout)*time.Second)
+	if s.rejectCheckedKey(c, req.Key, checkErr, req.AllowInvalid) {
+		return
 	}
 
-	// If refresh date is not provided, set to default value (1st of next month)
-	if req.RefreshesAt.IsZero() {
-		currentDate := time.Now()
-		req.RefreshesAt = time.Date(
-			currentDate.Year(), currentDate.Month(), 1, 0, 0, 0, 0, time.UTC,
-		).AddDate(0, 1, 0)
-		req.RefreshesAt = req.RefreshesAt.UTC()
+	// If quota limit is not provided, use the plan limit,
+	// or the remaining credits if the plan has no limit, or the default
+	if req.QuotaLimit <= 0 && info != nil {
+		req.QuotaLimit = info.QuotaLimit()
+	}
+	if req.QuotaLimit <= 0 {
+		req.QuotaLimit = s.cfg.DefaultQuotaLimit
 	}
 
 	// Add the API key
-	id, err := s.db.AddAPIKey(req.Key, req.QuotaLimit, req.RefreshesAt)
+	id, err := s.db.AddAPIKey(storage.NewAPIKey{
+		Key:         req.Key,
+		QuotaLimit:  req.QuotaLimit,
+		RefreshesAt: req.RefreshesAt,
+		ResetRule:   req.ResetRule,
+		Label:       req.Label,
+		Owner:       req.Owner,
+		Notes:       req.Notes,
+		ExpiresAt:   req.ExpiresAt,
+		Tags:        req.Tags,
+	})
+	if errors.Is(err, storage.ErrDuplicateKey) {
+		c.JSON(http.StatusConflict, gin.H{"error": "API key already exists"})
+		return
+	}
 	if err != nil {
 		s.logger.Errorf("Failed to add API key: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add API key"})
 		return
 	}
 
+	// Fill the account information from the check
+	if info != nil {
+		if err := s.db.StoreAPIKeyInfo(id, req.QuotaLimit, info); err != nil {
+			s.logger.Errorf("Failed to store API key %d information: %v", id, err)
+		}
+	}
+
 	key, err := s.db.GetAPIKey(id)
 	if err != nil {
 		s.logger.Errorf("Failed to get added API key: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve added API key"})
 		return
 	}
+	if checkErr != nil {
+		if err := s.updateCheckedState(key, checkErr); err != nil {
+			s.logger.Errorf("Failed to update API key state: %v", err)
+		}
+		if key, err = s.db.GetAPIKey(id); err != nil {
+			s.logger.Errorf("Failed to get added API key: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve added API key"})
+			return
+		}
+	}
 
 	// Mask the actual key value for security
 	key.Key = maskAPIKey(key.Key)
@@ -220,7 +392,38 @@ func (s *Server) addAPIKey(c *gin.Context) {
 	c.JSON(http.StatusCreated, key)
 }
 
-// deleteAPIKey deletes an API key
+// rejectCheckedKey answers the request with why a key secret failed its
+// check by client.ValidateAPIKey and returns true, unless the check passed
+// or allowInvalid is set
+func (s *Server) rejectCheckedKey(c *gin.Context, key string, checkErr error, allowInvalid bool) bool {
+	if checkErr != nil && !client.IsInvalidKey(checkErr) {
+		s.logger.Errorf("Failed to check API key %s: %v", maskAPIKey(key), checkErr)
+	}
+	if checkErr == nil || allowInvalid {
+		return false
+	}
+	switch {
+	case errors.Is(checkErr, client.ErrNoCredits):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API key has no credits left"})
+	case errors.Is(checkErr, client.ErrKeyRejected):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API key rejected by the API"})
+	default:
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to validate API key"})
+	}
+	return true
+}
+
+// listedAPIKeys returns the archived keys if the archived query parameter
+// is set, the keys in use otherwise
+func (s *Server) listedAPIKeys(c *gin.Context) ([]*storage.APIKey, error) {
+	if archived, _ := strconv.ParseBool(c.Query("archived")); archived {
+		return s.db.GetArchivedAPIKeys()
+	}
+	return s.db.GetAllAPIKeys()
+}
+
+// deleteAPIKey archives an API key
+// Its request log and history are kept, see purgeAPIKey
 func (s *Server) deleteAPIKey(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
@@ -229,8 +432,13 @@ func (s *Server) deleteAPIKey(c *gin.Context) {
 		return
 	}
 
-	if err := s.db.DeleteAPIKey(id); err != nil {
-		s.logger.Errorf("Failed to delete API key %d: %v", id, err)
+	err = s.db.ArchiveAPIKey(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to archive API key %d: %v", id, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete API key"})
 		return
 	}
@@ -238,9 +446,8 @@ func (s *Server) deleteAPIKey(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
-// updateAPIKey updates an API key
-// Only update is_active field for now
-func (s *Server) updateAPIKey(c *gin.Context) {
+// restoreAPIKey puts an archived API key back in use
+func (s *Server) restoreAPIKey(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
@@ -248,170 +455,302 @@ func (s *Server) updateAPIKey(c *gin.Context) {
 		return
 	}
 
-	var req struct {
-		IsActive *bool `json:"is_active"`
+	err = s.db.RestoreAPIKey(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to restore API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore API key"})
+		return
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// purgeAPIKey deletes an archived API key for good,
+// with the request log and history referencing it
+func (s *Server) purgeAPIKey(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
 		return
 	}
 
-	// Get current key
 	key, err := s.db.GetAPIKey(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
 	if err != nil {
 		s.logger.Errorf("Failed to get API key %d: %v", id, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API key"})
 		return
 	}
+	if key.ArchivedAt.IsZero() {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "API key must be archived before being purged",
+			"reason": "purging deletes the request log and history of the key, archive it with DELETE /keys/" + idStr + " first",
+		})
+		return
+	}
 
-	// Update fields if provided
-	if req.IsActive != nil {
-		if err := s.db.UpdateAPIKeyStatus(id, *req.IsActive, key.ErrorCount); err != nil {
-			s.logger.Errorf("Failed to update API key status: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update API key"})
-			return
-		}
+	if err := s.db.PurgeAPIKey(id); err != nil {
+		s.logger.Errorf("Failed to purge API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge API key"})
+		return
 	}
+
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
-// refreshSingleAPIKey refreshes one key
-// this is a helper function to refreshAPIKey and refreshAPIKeys
-func (s *Server) refreshSingleAPIKey(key *storage.APIKey) error {
-	// Check if key is valid and get remaining quota
-	isValid, remainingQuota, err := s.client.CheckAPIKey(key.Key)
+// updateAPIKey updates the fields of an API key given in the request,
+// leaving the others unchanged
+// is_active is kept as a shorthand for the active and disabled states,
+// and a new key secret is checked against /api-info unless allow_invalid is set
+func (s *Server) updateAPIKey(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return fmt.Errorf("failed to check API key %d: %v", key.ID, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
+		return
+	}
+
+	var req struct {
+		Key          *string    `json:"key"`
+		AllowInvalid bool       `json:"allow_invalid"`
+		QuotaLimit   *int       `json:"quota_limit"`
+		QuotaUsed    *int       `json:"quota_used"`
+		RefreshesAt  *time.Time `json:"refreshes_at"`
+		ResetRule    *string    `json:"reset_rule"`
+		State        string     `json:"state"`
+		Reason       string     `json:"reason"`
+		IsActive     *bool      `json:"is_active"`
+		Label        *string    `json:"label"`
+		Owner        *string    `json:"owner"`
+		Notes        *string    `json:"notes"`
+		ExpiresAt    *time.Time `json:"expires_at"`
+		Tags         []string   `json:"tags"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	s.db.UpdateAPIKeyUsage(key.ID, key.QuotaLimit-remainingQuota)
-	if key.IsActive != isValid {
-		if err := s.db.UpdateAPIKeyStatus(key.ID, isValid, key.ErrorCount+1); err != nil {
-			return fmt.Errorf("failed to update API key status: %v", err)
+
+	// Validate the fields before changing anything
+	update := storage.KeyUpdate{
+		Key:         req.Key,
+		QuotaLimit:  req.QuotaLimit,
+		QuotaUsed:   req.QuotaUsed,
+		RefreshesAt: req.RefreshesAt,
+		Label:       req.Label,
+		Owner:       req.Owner,
+		Notes:       req.Notes,
+		ExpiresAt:   req.ExpiresAt,
+		Tags:        req.Tags,
+	}
+	if req.Key != nil {
+		*req.Key = strings.TrimSpace(*req.Key)
+		if *req.Key == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "API key must not be empty"})
+			return
 		}
 	}
-	return nil
-}
+	if req.QuotaLimit != nil && *req.QuotaLimit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quota_limit must not be negative"})
+		return
+	}
+	if req.QuotaUsed != nil && *req.QuotaUsed < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quota_used must not be negative"})
+		return
+	}
+	if req.ResetRule != nil {
+		rule, err := storage.ParseResetRule(*req.ResetRule)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		update.ResetRule = &rule
+	}
+	if req.State == "" && req.IsActive != nil {
+		req.State = storage.StateDisabled
+		if *req.IsActive {
+			req.State = storage.StateActive
+		}
+	}
+	if req.State != "" && !storage.ValidState(req.State) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key state"})
+		return
+	}
 
-func (s *Server) refreshAPIKey(c *gin.Context) {
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
+	// Get current key
+	current, err := s.db.GetAPIKey(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
 		return
 	}
-	// Get key
-	key, err := s.db.GetAPIKey(id)
 	if err != nil {
 		s.logger.Errorf("Failed to get API key %d: %v", id, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API key"})
 		return
 	}
-	if err := s.refreshSingleAPIKey(key); err != nil {
-		s.logger.Errorf("Failed to refresh API key %d: %v", id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh API key"})
+
+	// The usage must stay within the limit, 0 meaning unlimited
+	if req.QuotaLimit != nil || req.QuotaUsed != nil {
+		quotaLimit, quotaUsed := current.QuotaLimit, current.QuotaUsed
+		if req.QuotaLimit != nil {
+			quotaLimit = *req.QuotaLimit
+		}
+		if req.QuotaUsed != nil {
+			quotaUsed = *req.QuotaUsed
+		}
+		if quotaLimit > 0 && quotaUsed > quotaLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quota_used must not exceed quota_limit"})
+			return
+		}
+	}
+
+	// Check the new key secret against the API
+	var info *client.KeyInfo
+	var checkErr error
+	if req.Key != nil {
+		info, checkErr = s.client.ValidateAPIKey(c.Request.Context(), *req.Key, time.Duration(s.cfg.RefreshTimeout)*time.Second)
+		if s.rejectCheckedKey(c, *req.Key, checkErr, req.AllowInvalid) {
+			return
+		}
+	}
+
+	// Update fields if provided
+	err = s.db.UpdateAPIKey(id, update)
+	if errors.Is(err, storage.ErrDuplicateKey) {
+		c.JSON(http.StatusConflict, gin.H{"error": "API key already exists"})
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to update API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update API key"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
-}
+	if req.State != "" {
+		reason := req.Reason
+		if reason == "" {
+			reason = "set by admin"
+		}
+		if err := s.db.SetAPIKeyState(id, req.State, reason, time.Time{}); err != nil {
+			s.logger.Errorf("Failed to update API key state: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update API key"})
+			return
+		}
+	}
 
-// refreshAPIKeys checks all API keys and updates their status
-func (s *Server) refreshAPIKeys(c *gin.Context) {
-	keys, err := s.db.GetAllAPIKeys()
+	key, err := s.db.GetAPIKey(id)
 	if err != nil {
-		s.logger.Errorf("Failed to get API keys: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API keys"})
+		s.logger.Errorf("Failed to get updated API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve updated API key"})
 		return
 	}
 
-	var updatedCount int
-	for _, key := range keys {
-		if err := s.refreshSingleAPIKey(key); err != nil {
-			s.logger.Errorf("Failed to refresh API key %d: %v", key.ID, err)
-			continue
+	// Fill the account information and state of the new key secret
+	if req.Key != nil && req.State == "" {
+		if info != nil && req.QuotaUsed == nil {
+			if err := s.db.StoreAPIKeyInfo(id, key.QuotaLimit, info); err != nil {
+				s.logger.Errorf("Failed to store API key %d information: %v", id, err)
+			}
+		}
+		if err := s.updateCheckedState(key, checkErr); err != nil {
+			s.logger.Errorf("Failed to update API key state: %v", err)
+		}
+		if key, err = s.db.GetAPIKey(id); err != nil {
+			s.logger.Errorf("Failed to get updated API key %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve updated API key"})
+			return
 		}
-		updatedCount++
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"status":       "ok",
-		"total_keys":   len(keys),
-		"updated_keys": updatedCount,
-	})
+
+	// Mask the actual key value for security
+	key.Key = maskAPIKey(key.Key)
+
+	c.JSON(http.StatusOK, key)
 }
 
-// proxyRequest proxies a request to the configured API
-func (s *Server) proxyRequest(c *gin.Context) {
-	// Extract path and query parameters from the request
-	path := c.Param("path")
-	query := c.Request.URL.Query()
+// getExpiringAPIKeys returns the keys expiring within the days given
+// by the days query parameter (30 by default), expired ones included
+func (s *Server) getExpiringAPIKeys(c *gin.Context) {
+	days := 30
+	if daysStr := c.Query("days"); daysStr != "" {
+		var err error
+		if days, err = strconv.Atoi(daysStr); err != nil || days < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid number of days"})
+			return
+		}
+	}
 
-	// Get an available API key
-	s.keyMutex.Lock()
-	key, err := s.db.GetAvailableAPIKey()
+	keys, err := s.db.GetExpiringAPIKeys(time.Now().AddDate(0, 0, days))
 	if err != nil {
-		s.keyMutex.Unlock()
-		s.logger.Errorf("Failed to get available API key: %v", err)
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No available API keys"})
-		return
-	}
-
-	// Increment usage before making the request
-	// This prevents simultaneous requests from exceeding quota
-	// By default, cost_per_request is 0
-	// because only part of queries will increment the quota used
-	if err := s.db.IncrementAPIKeyUsage(key.ID, s.cfg.CostPerRequest); err != nil {
-		s.keyMutex.Unlock()
-		s.logger.Errorf("Failed to increment API key usage: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update API key usage"})
-		return
-	}
-	s.keyMutex.Unlock()
-
-	// Forward the request to the API
-	// And log the forwarded request for debug
-	s.logger.Debugf("Forwarding request to %s with key %s", path, maskAPIKey(key.Key))
-	s.logger.Debugf("URL: %s", c.Request.URL)
-	s.logger.Debugf("Method: %s", c.Request.Method)
-	s.logger.Debugf("Headers: %v", c.Request.Header)
-	s.logger.Debugf("Body: %v", c.Request.Body)
-	s.logger.Debugf("Params: %v", c.Request.URL.Query())
-	s.logger.Debugf("Path: %s", path)
-	resp, err := s.client.Do(c.Request.Method, path, c.Request.Body, key.Key, query)
-	if err != nil {
-		s.logger.Errorf("API request failed: %v", err)
+		s.logger.Errorf("Failed to get expiring API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API keys"})
+		return
+	}
 
-		// If the request failed, try to restore the quota (optional)
-		if updateErr := s.db.IncrementAPIKeyUsage(key.ID, -s.cfg.CostPerRequest); updateErr != nil {
-			s.logger.Errorf("Failed to restore API key usage: %v", updateErr)
-		}
+	// Mask the actual key values for security
+	for _, key := range keys {
+		key.Key = maskAPIKey(key.Key)
+	}
+	if keys == nil {
+		keys = []*storage.APIKey{}
+	}
 
-		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reach API"})
+	c.JSON(http.StatusOK, keys)
+}
+
+// getAPIKeyEvents returns the state history of an API key
+func (s *Server) getAPIKeyEvents(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
 		return
 	}
-	defer resp.Body.Close()
 
-	// Check if the response indicates an API key error
-	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
-		// Update key status
-		if err := s.db.UpdateAPIKeyStatus(key.ID, false, key.ErrorCount+1); err != nil {
-			s.logger.Errorf("Failed to update API key status: %v", err)
-		}
+	_, err = s.db.GetAPIKey(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to get API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API key"})
+		return
 	}
 
-	// Copy headers from API response
-	for k, v := range resp.Header {
-		c.Writer.Header()[k] = v
+	events, err := s.db.GetAPIKeyEvents(id)
+	if err != nil {
+		s.logger.Errorf("Failed to get API key %d events: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API key events"})
+		return
 	}
-	c.Writer.WriteHeader(resp.StatusCode)
 
-	// Copy response body
-	io.Copy(c.Writer, resp.Body)
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// purgeCache removes all cached responses
+func (s *Server) purgeCache(c *gin.Context) {
+	if s.cache == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	if err := s.cache.Purge(); err != nil {
+		s.logger.Errorf("Failed to purge cache: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge cache"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
 // maskAPIKey masks the API key for display purposes
 func maskAPIKey(key string) string {
-	if len(key) < 4 {
-		return "****"
-	}
-	return key[:4] + "****"
+	return keyio.MaskKey(key)
 }
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"shodone/internal/storage"
+)
+
+func TestUpdateAPIKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"label only", `{"label": "main"}`, http.StatusOK},
+		{"usage within the limit", `{"quota_used": 10}`, http.StatusOK},
+		{"usage and limit", `{"quota_limit": 50, "quota_used": 40}`, http.StatusOK},
+		{"unlimited", `{"quota_limit": 0, "quota_used": 500}`, http.StatusOK},
+		{"usage above the limit", `{"quota_used": 11}`, http.StatusBadRequest},
+		{"limit below the usage", `{"quota_limit": 4}`, http.StatusBadRequest},
+		{"usage above the new limit", `{"quota_limit": 20, "quota_used": 21}`, http.StatusBadRequest},
+		{"negative usage", `{"quota_used": -1}`, http.StatusBadRequest},
+		{"negative limit", `{"quota_limit": -1}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestServer(t, http.NotFoundHandler())
+			ids := addTestKeys(t, db, "FIRSTKEY")
+			if err := db.UpdateAPIKeyUsage(ids[0], 5); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := serve(s, http.MethodPatch, "/keys/1", strings.NewReader(tt.body))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				key, _ := db.GetAPIKey(ids[0])
+				if key.QuotaLimit != 10 || key.QuotaUsed != 5 {
+					t.Errorf("rejected update changed the key to %d/%d", key.QuotaUsed, key.QuotaLimit)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateAPIKeyLookupErrors(t *testing.T) {
+	s, db := newTestServer(t, http.NotFoundHandler())
+	addTestKeys(t, db, "FIRSTKEY")
+
+	if rec := serve(s, http.MethodPatch, "/keys/42", strings.NewReader(`{"label": "x"}`)); rec.Code != http.StatusNotFound {
+		t.Errorf("status of a missing key = %d, want 404", rec.Code)
+	}
+	db.Close()
+	if rec := serve(s, http.MethodPatch, "/keys/1", strings.NewReader(`{"label": "x"}`)); rec.Code != http.StatusInternalServerError {
+		t.Errorf("status with a broken database = %d, want 500", rec.Code)
+	}
+}
+
+func TestPurgeAPIKey(t *testing.T) {
+	s, db := newTestServer(t, http.NotFoundHandler())
+	ids := addTestKeys(t, db, "FIRSTKEY")
+
+	if rec := serve(s, http.MethodDelete, "/keys/42/purge", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("status of a missing key = %d, want 404", rec.Code)
+	}
+	rec := serve(s, http.MethodDelete, "/keys/1/purge", nil)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "archive") {
+		t.Errorf("status of a key in use = %d, want 409 saying why: %s", rec.Code, rec.Body)
+	}
+
+	if err := db.ArchiveAPIKey(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(s, http.MethodDelete, "/keys/1/purge", nil); rec.Code != http.StatusOK {
+		t.Errorf("status of an archived key = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if exists, _ := db.HasAPIKey("FIRSTKEY"); exists {
+		t.Error("purged key is still stored")
+	}
+
+	db.Close()
+	if rec := serve(s, http.MethodDelete, "/keys/1/purge", nil); rec.Code != http.StatusInternalServerError {
+		t.Errorf("status with a broken database = %d, want 500", rec.Code)
+	}
+}
+
+func TestAddAPIKeyWithoutCredits(t *testing.T) {
+	// A free plan out of credits, whose host lookups would still be free
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"query_credits": 0, "scan_credits": 0, "plan": "oss", "usage_limits": {"query_credits": 100}}`)
+	})
+	s, db := newTestServer(t, upstream)
+
+	rec := serve(s, http.MethodPost, "/keys/", strings.NewReader(`{"key": "FREEKEY"}`))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(s, http.MethodPost, "/keys/", strings.NewReader(`{"key": "FREEKEY", "allow_invalid": true}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status with allow_invalid = %d, want 201: %s", rec.Code, rec.Body)
+	}
+	keys, err := db.GetAllAPIKeys()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("keys = %v, %v, want one", keys, err)
+	}
+	if keys[0].State != storage.StateExhausted || keys[0].Plan != "oss" {
+		t.Errorf("key state %q, plan %q, want exhausted oss", keys[0].State, keys[0].Plan)
+	}
+
+	// Not even free host lookups are sent with it
+	if rec := serve(s, http.MethodGet, "/shodan/host/1.2.3.4", nil); rec.Code == http.StatusOK {
+		t.Errorf("host lookup answered %d with an exhausted key", rec.Code)
+	}
+}
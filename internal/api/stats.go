@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"shodone/internal/storage"
+)
+
+// defaultTopQueries is how many queries /stats/queries lists by default
+const defaultTopQueries = 10
+
+// getStats returns a handler summing up the request log by key, day,
+// endpoint, client or query
+// It is filtered by the from and to query parameters, limited by limit,
+// and written as JSON or, with format=csv, as CSV
+func (s *Server) getStats(groupBy string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format := c.DefaultQuery("format", "json")
+		if format != "json" && format != "csv" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format " + format})
+			return
+		}
+		from, err := parseTimeParam(c, "from")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to, err := parseTimeParam(c, "to")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defaultLimit := 0
+		if groupBy == storage.StatsByQuery {
+			defaultLimit = defaultTopQueries
+		}
+		limit, err := parseIntParam(c, "limit", defaultLimit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		stats, err := s.db.GetUsageStats(groupBy, from, to, limit)
+		if err != nil {
+			s.logger.Errorf("Failed to get usage statistics by %s: %v", groupBy, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get usage statistics"})
+			return
+		}
+
+		if format == "csv" {
+			var buf bytes.Buffer
+			if err := writeStatsCSV(&buf, groupBy, stats); err != nil {
+				s.logger.Errorf("Failed to write usage statistics: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write usage statistics"})
+				return
+			}
+			c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"by": groupBy, "stats": stats})
+	}
+}
+
+// writeStatsCSV writes usage statistics as CSV, naming the group column after the grouping
+func writeStatsCSV(buf *bytes.Buffer, groupBy string, stats []*storage.UsageStat) error {
+	writer := csv.NewWriter(buf)
+	header := []string{groupBy}
+	if groupBy == storage.StatsByKey {
+		header = append(header, "label")
+	}
+	header = append(header, "requests", "cached", "query_credits", "scan_credits", "errors", "error_rate")
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, stat := range stats {
+		row := []string{stat.Group}
+		if groupBy == storage.StatsByKey {
+			row = append(row, stat.Label)
+		}
+		row = append(row,
+			strconv.Itoa(stat.Requests), strconv.Itoa(stat.Cached),
+			strconv.Itoa(stat.QueryCredits), strconv.Itoa(stat.ScanCredits),
+			strconv.Itoa(stat.Errors), strconv.FormatFloat(stat.ErrorRate, 'f', 4, 64),
+		)
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
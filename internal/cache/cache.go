@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Entry represents a cached upstream response
+type Entry struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	ExpiresAt  time.Time   `json:"expires_at"`
+}
+
+// Cache stores upstream responses for a limited time
+// Get returns nil without error when the key is not cached or has expired,
+// and Prune removes the expired entries, returning how many were removed
+type Cache interface {
+	Get(key string) (*Entry, error)
+	Set(key string, entry *Entry, ttl time.Duration) error
+	Prune() (int, error)
+	Purge() error
+}
+
+// Key builds the cache key of a request from its method, path and query
+// The `key` parameter is excluded, so the same query sent with different
+// API keys shares one cache entry
+func Key(method, path string, query url.Values) string {
+	return method + " " + path + "?" + NormalizeQuery(query)
+}
+
+// NormalizeQuery encodes the query parameters sorted by name, without the key
+func NormalizeQuery(query url.Values) string {
+	normalized := url.Values{}
+	for k, v := range query {
+		if k == "key" {
+			continue
+		}
+		normalized[k] = v
+	}
+	// Encode sorts the parameters by name
+	return normalized.Encode()
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"shodone/internal/storage"
+)
+
+func TestKey(t *testing.T) {
+	a := Key("GET", "/shodan/host/search", url.Values{"query": {"apache"}, "page": {"2"}, "key": {"FIRSTKEY"}})
+	b := Key("GET", "/shodan/host/search", url.Values{"page": {"2"}, "key": {"SECONDKEY"}, "query": {"apache"}})
+	if a != b {
+		t.Errorf("keys differ by API key or parameter order: %q and %q", a, b)
+	}
+	if want := "GET /shodan/host/search?page=2&query=apache"; a != want {
+		t.Errorf("Key = %q, want %q", a, want)
+	}
+	if c := Key("GET", "/shodan/host/search", url.Values{"query": {"nginx"}}); c == a {
+		t.Error("different queries share a key")
+	}
+	if d := Key("POST", "/shodan/host/search", url.Values{"query": {"apache"}, "page": {"2"}}); d == a {
+		t.Error("different methods share a key")
+	}
+}
+
+// backends returns a fresh cache of each backend holding at most maxEntries
+func backends(t *testing.T, maxEntries int) map[string]Cache {
+	t.Helper()
+	db, err := storage.New(filepath.Join(t.TempDir(), "shodone.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]Cache{
+		"memory": NewMemory(maxEntries),
+		"sqlite": NewSQLite(db, maxEntries),
+	}
+}
+
+// newEntry returns an entry with the given body
+func newEntry(body string) *Entry {
+	return &Entry{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       []byte(body),
+	}
+}
+
+// assertCached fails unless key holds body, or nothing if body is empty
+func assertCached(t *testing.T, c Cache, key, body string) {
+	t.Helper()
+	entry, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	switch {
+	case body == "" && entry != nil:
+		t.Errorf("Get(%q) = %q, want nothing", key, entry.Body)
+	case body != "" && entry == nil:
+		t.Errorf("Get(%q) = nothing, want %q", key, body)
+	case body != "" && string(entry.Body) != body:
+		t.Errorf("Get(%q) = %q, want %q", key, entry.Body, body)
+	}
+}
+
+func TestCacheGetSet(t *testing.T) {
+	for name, c := range backends(t, 0) {
+		t.Run(name, func(t *testing.T) {
+			assertCached(t, c, "missing", "")
+
+			if err := c.Set("a", newEntry("first"), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			entry, err := c.Get("a")
+			if err != nil || entry == nil {
+				t.Fatalf("Get = %v, %v", entry, err)
+			}
+			if entry.StatusCode != http.StatusOK || entry.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("entry = %d %v, want the stored status and header", entry.StatusCode, entry.Header)
+			}
+
+			// Setting again replaces the entry
+			if err := c.Set("a", newEntry("second"), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			assertCached(t, c, "a", "second")
+
+			if err := c.Purge(); err != nil {
+				t.Fatal(err)
+			}
+			assertCached(t, c, "a", "")
+		})
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	for name, c := range backends(t, 0) {
+		t.Run(name, func(t *testing.T) {
+			if err := c.Set("fresh", newEntry("fresh"), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Set("stale", newEntry("stale"), -time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Set("other stale", newEntry("stale"), -time.Second); err != nil {
+				t.Fatal(err)
+			}
+
+			assertCached(t, c, "fresh", "fresh")
+			assertCached(t, c, "stale", "")
+
+			// Get already dropped one expired entry, Prune drops the other
+			removed, err := c.Prune()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != 1 {
+				t.Errorf("Prune removed %d entries, want 1", removed)
+			}
+			assertCached(t, c, "fresh", "fresh")
+		})
+	}
+}
+
+func TestMemoryLRU(t *testing.T) {
+	c := NewMemory(2)
+	c.Set("a", newEntry("a"), time.Hour)
+	c.Set("b", newEntry("b"), time.Hour)
+
+	// Reading a makes b the least recently used entry
+	assertCached(t, c, "a", "a")
+	c.Set("c", newEntry("c"), time.Hour)
+
+	assertCached(t, c, "b", "")
+	assertCached(t, c, "a", "a")
+	assertCached(t, c, "c", "c")
+
+	// Updating an entry does not evict anything
+	c.Set("a", newEntry("a2"), time.Hour)
+	assertCached(t, c, "a", "a2")
+	assertCached(t, c, "c", "c")
+}
+
+func TestSQLitePrune(t *testing.T) {
+	c := backends(t, 2)["sqlite"]
+	c.Set("expired", newEntry("expired"), -time.Second)
+	c.Set("soon", newEntry("soon"), time.Minute)
+	c.Set("later", newEntry("later"), time.Hour)
+	c.Set("latest", newEntry("latest"), 2*time.Hour)
+
+	removed, err := c.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("Prune removed %d entries, want the expired one and the one expiring first", removed)
+	}
+	assertCached(t, c, "soon", "")
+	assertCached(t, c, "later", "later")
+	assertCached(t, c, "latest", "latest")
+
+	// Within the limit nothing else goes
+	if removed, _ := c.Prune(); removed != 0 {
+		t.Errorf("second Prune removed %d entries, want 0", removed)
+	}
+}
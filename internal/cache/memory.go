@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory LRU cache
+type Memory struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List
+	items      map[string]*list.Element
+}
+
+// memoryItem is the value stored in the LRU list
+type memoryItem struct {
+	key   string
+	entry *Entry
+}
+
+// NewMemory creates a new in-memory LRU cache holding at most maxEntries entries
+func NewMemory(maxEntries int) *Memory {
+	return &Memory{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached entry for key
+func (m *Memory) Get(key string) (*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, nil
+	}
+	item := elem.Value.(*memoryItem)
+	if time.Now().After(item.entry.ExpiresAt) {
+		m.order.Remove(elem)
+		delete(m.items, key)
+		return nil, nil
+	}
+	m.order.MoveToFront(elem)
+	return item.entry, nil
+}
+
+// Set stores entry under key for ttl, evicting the least recently used
+// entries when the cache is full
+func (m *Memory) Set(key string, entry *Entry, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry.ExpiresAt = time.Now().Add(ttl)
+	if elem, ok := m.items[key]; ok {
+		elem.Value.(*memoryItem).entry = entry
+		m.order.MoveToFront(elem)
+		return nil
+	}
+	m.items[key] = m.order.PushFront(&memoryItem{key: key, entry: entry})
+
+	for m.maxEntries > 0 && m.order.Len() > m.maxEntries {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.items, oldest.Value.(*memoryItem).key)
+	}
+	return nil
+}
+
+// Prune removes the expired entries
+func (m *Memory) Prune() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var removed int
+	for key, elem := range m.items {
+		if now.After(elem.Value.(*memoryItem).entry.ExpiresAt) {
+			m.order.Remove(elem)
+			delete(m.items, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Purge removes all entries
+func (m *Memory) Purge() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.order.Init()
+	m.items = make(map[string]*list.Element)
+	return nil
+}
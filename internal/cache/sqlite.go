@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"shodone/internal/storage"
+)
+
+// SQLite is a persistent cache backed by the response_cache table
+type SQLite struct {
+	db         *storage.DB
+	maxEntries int
+}
+
+// NewSQLite creates a new cache backed by the given database, which Prune
+// trims down to maxEntries entries
+func NewSQLite(db *storage.DB, maxEntries int) *SQLite {
+	return &SQLite{db: db, maxEntries: maxEntries}
+}
+
+// Get returns the cached entry for key
+func (s *SQLite) Get(key string) (*Entry, error) {
+	cached, err := s.db.GetCachedResponse(key, time.Now())
+	if err != nil || cached == nil {
+		return nil, err
+	}
+
+	entry := &Entry{
+		StatusCode: cached.StatusCode,
+		Body:       cached.Body,
+		ExpiresAt:  cached.ExpiresAt,
+	}
+	if err := json.Unmarshal(cached.Header, &entry.Header); err != nil {
+		return nil, fmt.Errorf("failed to decode cached header: %w", err)
+	}
+	return entry, nil
+}
+
+// Set stores entry under key for ttl
+func (s *SQLite) Set(key string, entry *Entry, ttl time.Duration) error {
+	header, err := json.Marshal(entry.Header)
+	if err != nil {
+		return fmt.Errorf("failed to encode header: %w", err)
+	}
+	entry.ExpiresAt = time.Now().Add(ttl)
+	return s.db.SetCachedResponse(&storage.CachedResponse{
+		Key:        key,
+		StatusCode: entry.StatusCode,
+		Header:     header,
+		Body:       entry.Body,
+		ExpiresAt:  entry.ExpiresAt,
+	})
+}
+
+// Prune removes the expired entries, then the ones expiring first
+// beyond the maximum number of entries
+func (s *SQLite) Prune() (int, error) {
+	return s.db.PruneCachedResponses(time.Now(), s.maxEntries)
+}
+
+// Purge removes all entries
+func (s *SQLite) Purge() error {
+	return s.db.PurgeCachedResponses()
+}
@@ -1,7 +1,9 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -31,41 +33,25 @@ func (c *Client) SetBaseURL(baseURL string) {
 }
 
 // BuildURL builds a URL with the given path, key, and URL parameters
-//
-//	func (c *Client) BuildURL(path, apiKey string, urlParams map[string]string) (string, error) {
-//		// Create URL
-//		url, err := url.Parse(c.baseURL + path)
-//		if err != nil {
-//			return "", fmt.Errorf("failed to parse URL: %w", err)
-//		}
-//		// Add API key and URL parameters as query parameters
-//		q := url.Query()
-//		if apiKey != "" {
-//			q.Set("key", apiKey)
-//		}
-//		for k, v := range urlParams {
-//			q.Set(k, v)
-//		}
-//		if len(q) > 0 {
-//			url.RawQuery = q.Encode()
-//		}
-//		return url.String(), nil
-//
-// /}
+// A key parameter among the URL parameters is dropped, so it never
+// overrides the given key
 func (c *Client) BuildURL(path, apiKey string, urlParams url.Values) (string, error) {
 	// Create URL
 	url, err := url.Parse(c.baseURL + path)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse URL: %w", err)
 	}
-	// Add API key and URL parameters as query parameters
+	// Add URL parameters and API key as query parameters
 	q := url.Query()
+	for k, v := range urlParams {
+		if k == "key" {
+			continue
+		}
+		q[k] = v
+	}
 	if apiKey != "" {
 		q.Set("key", apiKey)
 	}
-	for k, v := range urlParams {
-		q.Set(k, v[0])
-	}
 	if len(q) > 0 {
 		url.RawQuery = q.Encode()
 	}
@@ -74,13 +60,18 @@ func (c *Client) BuildURL(path, apiKey string, urlParams url.Values) (string, er
 
 // Do performs a request to the API with the given API key and returns the response
 func (c *Client) Do(method, path string, body io.Reader, apiKey string, urlParams url.Values) (*http.Response, error) {
+	return c.DoContext(context.Background(), method, path, body, apiKey, urlParams)
+}
+
+// DoContext performs a request like Do, bounded by the given context
+func (c *Client) DoContext(ctx context.Context, method, path string, body io.Reader, apiKey string, urlParams url.Values) (*http.Response, error) {
 	// Build URL
 	url, err := c.BuildURL(path, apiKey, urlParams)
 	if err != nil {
 		return nil, err
 	}
 	// Perform request
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -98,58 +89,134 @@ func (c *Client) Do(method, path string, body io.Reader, apiKey string, urlParam
 	return resp, nil
 }
 
+// UsageLimits represents the monthly limits of a Shodan plan
+type UsageLimits struct {
+	ScanCredits  int `json:"scan_credits"`
+	QueryCredits int `json:"query_credits"`
+	MonitoredIPs int `json:"monitored_ips"`
+}
+
+// KeyInfo represents the account information returned by /api-info
+// example response:
+//
+//	{
+//	    "scan_credits": 100000,
+//	    "usage_limits": {
+//	        "scan_credits": -1,
+//	        "query_credits": -1,
+//	        "monitored_ips": -1
+//	    },
+//	    "plan": "stream-100",
+//	    "https": false,
+//	    "unlocked": true,
+//	    "query_credits": 100000,
+//	    "monitored_ips": 19,
+//	    "unlocked_left": 100000,
+//	    "telnet": false
+//	}
+type KeyInfo struct {
+	ScanCredits  int         `json:"scan_credits"`
+	UsageLimits  UsageLimits `json:"usage_limits"`
+	Plan         string      `json:"plan"`
+	HTTPS        bool        `json:"https"`
+	Unlocked     bool        `json:"unlocked"`
+	QueryCredits int         `json:"query_credits"`
+	MonitoredIPs int         `json:"monitored_ips"`
+	UnlockedLeft int         `json:"unlocked_left"`
+	Telnet       bool        `json:"telnet"`
+}
+
+// QuotaLimit returns the query credit limit of the plan, or the remaining
+// credits if the plan has no limit, 0 if neither is known
+func (i *KeyInfo) QuotaLimit() int {
+	if i.UsageLimits.QueryCredits > 0 {
+		return i.UsageLimits.QueryCredits
+	}
+	return max(i.QueryCredits, 0)
+}
+
+// StatusError is returned when the API answers a key check with an error
+// status that does not reject the key itself, such as 429 or 5xx
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API answered with status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// IsRateLimited reports whether err is a key check answered with 429 Too Many Requests
+func IsRateLimited(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests
+}
+
 // CheckAPIKey checks if an API key is valid by making a simple request
-func (c *Client) CheckAPIKey(apiKey string) (bool, int, error) {
+// A key is valid if it has query or scan credits left, and its account
+// information is returned whenever the API answered successfully
+// Keys out of credits are not valid even though some endpoints like host
+// lookups are free: the pool charges requests against the quota only, so
+// such a key would also be picked for requests that cost credits
+// Only 401 and 403 reject the key, other error statuses return a *StatusError
+func (c *Client) CheckAPIKey(ctx context.Context, apiKey string) (bool, *KeyInfo, error) {
 	// Make a request to the API's key info endpoint
-	resp, err := c.Do("GET", "/api-info", nil, apiKey, nil)
+	resp, err := c.DoContext(ctx, "GET", "/api-info", nil, apiKey, nil)
 	if err != nil {
-		return false, 0, err
+		return false, nil, err
 	}
 	defer resp.Body.Close()
 
-	// If the API responds with an error status, the key is invalid or expired
-	if resp.StatusCode >= 400 {
-		return false, 0, nil
-	}
-
-	// Parse the response to get the remaining quota
-	// the remaining quota is in field `query_credits`
-	// example response:
-	// 	{
-	//     "scan_credits": 100000,
-	//     "usage_limits": {
-	//         "scan_credits": -1,
-	//         "query_credits": -1,
-	//         "monitored_ips": -1
-	//     },
-	//     "plan": "stream-100",
-	//     "https": false,
-	//     "unlocked": true,
-	//     "query_credits": 100000,
-	//     "monitored_ips": 19,
-	//     "unlocked_left": 100000,
-	//     "telnet": false
-	// }
-	var keyInfo struct {
-		ScanCredits int `json:"scan_credits"`
-		UsageLimits struct {
-			ScanCredits  int `json:"scan_credits"`
-			QueryCredits int `json:"query_credits"`
-			MonitoredIPs int `json:"monitored_ips"`
-		} `json:"usage_limits"`
-		Plan         string `json:"plan"`
-		HTTPS        bool   `json:"https"`
-		Unlocked     bool   `json:"unlocked"`
-		QueryCredits int    `json:"query_credits"`
-		MonitoredIPs int    `json:"monitored_ips"`
-		UnlockedLeft int    `json:"unlocked_left"`
-		Telnet       bool   `json:"telnet"`
+	// If the API refuses the key, it is invalid or expired
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, nil, nil
+	case resp.StatusCode >= 400:
+		return false, nil, &StatusError{StatusCode: resp.StatusCode}
 	}
+
+	var keyInfo KeyInfo
 	if err := json.NewDecoder(resp.Body).Decode(&keyInfo); err != nil {
-		return false, 0, fmt.Errorf("failed to parse response: %w", err)
+		return false, nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if keyInfo.QueryCredits <= 0 && keyInfo.ScanCredits <= 0 {
+		return false, &keyInfo, nil
+	}
+	return true, &keyInfo, nil
+}
+
+// Errors returned by ValidateAPIKey for keys the API answered about
+var (
+	ErrKeyRejected = errors.New("rejected by the API")
+	ErrNoCredits   = errors.New("no credits left")
+)
+
+// IsInvalidKey reports whether err is ValidateAPIKey finding the key
+// rejected or out of credits, rather than failing to check it
+func IsInvalidKey(err error) bool {
+	return errors.Is(err, ErrKeyRejected) || errors.Is(err, ErrNoCredits)
+}
+
+// ValidateAPIKey checks a key like CheckAPIKey, giving up after timeout
+// if positive, and returns its account information
+// Keys the API rejects return ErrKeyRejected, and keys out of credits
+// return their account information along with ErrNoCredits
+// Any other error means the key could not be checked
+func (c *Client) ValidateAPIKey(ctx context.Context, apiKey string, timeout time.Duration) (*KeyInfo, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	if keyInfo.QueryCredits <= 0 {
-		return false, 0, nil
+
+	isValid, info, err := c.CheckAPIKey(ctx, apiKey)
+	switch {
+	case err != nil:
+		return nil, err
+	case isValid:
+		return info, nil
+	case info != nil:
+		return info, ErrNoCredits
+	default:
+		return nil, ErrKeyRejected
 	}
-	return true, keyInfo.QueryCredits, nil
 }
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateAPIKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantErr     error
+		invalid     bool
+		rateLimited bool
+		wantInfo    bool
+	}{
+		{name: "valid", status: http.StatusOK, body: `{"query_credits": 10, "plan": "dev"}`, wantInfo: true},
+		{name: "scan credits only", status: http.StatusOK, body: `{"scan_credits": 5}`, wantInfo: true},
+		{name: "no credits", status: http.StatusOK, body: `{"query_credits": 0}`, wantErr: ErrNoCredits, invalid: true, wantInfo: true},
+		{name: "free plan out of credits", status: http.StatusOK, body: `{"query_credits": 0, "scan_credits": 0, "plan": "oss", "usage_limits": {"query_credits": 100}}`, wantErr: ErrNoCredits, invalid: true, wantInfo: true},
+		{name: "unauthorized", status: http.StatusUnauthorized, wantErr: ErrKeyRejected, invalid: true},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: ErrKeyRejected, invalid: true},
+		{name: "rate-limited", status: http.StatusTooManyRequests, rateLimited: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable},
+		{name: "server error", status: http.StatusInternalServerError},
+		{name: "malformed response", status: http.StatusOK, body: `{`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer upstream.Close()
+
+			info, err := New(upstream.URL).ValidateAPIKey(context.Background(), "KEY", 0)
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && tt.wantInfo && err != nil {
+				t.Errorf("error = %v, want none", err)
+			}
+			if !tt.wantInfo && err == nil {
+				t.Error("no error, want one")
+			}
+			if got := IsInvalidKey(err); got != tt.invalid {
+				t.Errorf("IsInvalidKey = %v, want %v", got, tt.invalid)
+			}
+			if got := IsRateLimited(err); got != tt.rateLimited {
+				t.Errorf("IsRateLimited = %v, want %v", got, tt.rateLimited)
+			}
+			if got := info != nil; got != tt.wantInfo {
+				t.Errorf("info = %+v, want info %v", info, tt.wantInfo)
+			}
+		})
+	}
+}
+
+func TestValidateAPIKeyUnreachable(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	_, err := New(upstream.URL).ValidateAPIKey(context.Background(), "KEY", 0)
+	if err == nil || IsInvalidKey(err) || IsRateLimited(err) {
+		t.Errorf("error = %v, want a transport error", err)
+	}
+}
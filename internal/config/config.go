@@ -3,8 +3,14 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"shodone/internal/cost"
+	"shodone/internal/plan"
 )
 
 // Config holds the application configuration
@@ -20,30 +26,161 @@ type Config struct {
 	DatabasePath string `json:"database_path"`
 
 	// API key usage settings
-	DefaultQuotaLimit int `json:"default_quota_limit"`
-	CostPerRequest    int `json:"cost_per_request"`
+	// CostRules work out the credits each proxied request spends,
+	// and CostPerRequest is charged for requests matching no rule
+	DefaultQuotaLimit int         `json:"default_quota_limit"`
+	CostPerRequest    int         `json:"cost_per_request"`
+	CostRules         []cost.Rule `json:"cost_rules"`
+
+	// MaxAttempts is how many keys a request may try when the upstream
+	// rejects a key (invalid, out of credits or rate-limited)
+	MaxAttempts int `json:"max_attempts"`
+
+	// RateLimitCooldown is how long a rate-limited key rests in seconds
+	RateLimitCooldown int `json:"rate_limit_cooldown"`
+
+	// KeyStrategy selects keys: balanced, round-robin, weighted,
+	// least-recently-used, drain or random
+	// PoolStrategies overrides it per pool
+	KeyStrategy    string            `json:"key_strategy"`
+	PoolStrategies map[string]string `json:"pool_strategies"`
+
+	// ClientKeyMode is how the key query parameter sent by clients is handled:
+	// "strip" ignores it, "passthrough" forwards the request with the client's
+	// own key instead of a pooled one, and "token" requires it to be one of
+	// AccessTokens, which maps each token to the pool it may use ("" for all keys)
+	ClientKeyMode string            `json:"client_key_mode"`
+	AccessTokens  map[string]string `json:"access_tokens"`
+
+	// PlanCapabilities lists the capabilities (scan, bulk_data, stream,
+	// vuln_filter, tag_filter) unlocked by each Shodan plan
+	PlanCapabilities map[string][]string `json:"plan_capabilities"`
+
+	// DiscoverKeys imports the keys found on the machine at startup:
+	// SHODAN_API_KEY, the Shodan CLI key file and SHODONE_KEYS_FILE
+	// The SHODONE_DISCOVER_KEYS environment variable overrides it
+	DiscoverKeys bool `json:"discover_keys"`
+
+	// Background job intervals in seconds, 0 disables the job
+	QuotaResetInterval int `json:"quota_reset_interval"`
+	KeyCheckInterval   int `json:"key_check_interval"`
+	CachePruneInterval int `json:"cache_prune_interval"`
+
+	// Key probe settings, in seconds
+	// ProbeInterval is how often invalid and exhausted keys due for a probe
+	// are re-checked, and each failed probe doubles the wait from
+	// ProbeBackoff up to ProbeBackoffMax
+	ProbeInterval   int `json:"probe_interval"`
+	ProbeBackoff    int `json:"probe_backoff"`
+	ProbeBackoffMax int `json:"probe_backoff_max"`
+
+	// Forecast settings, in seconds
+	// ForecastWindow is how far back the request log is read to work out
+	// the spending rate of keys, and ForecastInterval is how often the
+	// pool forecast is checked to warn before it runs dry (0 disables it)
+	ForecastWindow   int `json:"forecast_window"`
+	ForecastInterval int `json:"forecast_interval"`
+
+	// Key refresh settings
+	// RefreshConcurrency is how many keys are checked at once, and
+	// RefreshTimeout bounds the check of a single key in seconds
+	RefreshConcurrency int `json:"refresh_concurrency"`
+	RefreshTimeout     int `json:"refresh_timeout"`
+
+	// Response cache settings
+	// CacheBackend is one of "memory", "sqlite" or "none"
+	// CacheTTL is the default time to live in seconds, and CacheRouteTTLs
+	// overrides it by path prefix (0 disables caching for the route)
+	CacheBackend    string         `json:"cache_backend"`
+	CacheTTL        int            `json:"cache_ttl"`
+	CacheMaxEntries int            `json:"cache_max_entries"`
+	CacheRouteTTLs  map[string]int `json:"cache_route_ttls"`
 }
 
 // Default configuration values
 const (
-	DefaultHost           = "localhost"
-	DefaultPort           = 8080
-	DefaultAPIHost        = "https://api.shodan.io"
-	DefaultDatabaseDir    = "./data"
-	DefaultQuotaLimit     = 100
-	DefaultCostPerRequest = 0
+	DefaultHost               = "localhost"
+	DefaultPort               = 8080
+	DefaultAPIHost            = "https://api.shodan.io"
+	DefaultDatabaseDir        = "./data"
+	DefaultQuotaLimit         = 100
+	DefaultCostPerRequest     = 0
+	DefaultMaxAttempts        = 3
+	DefaultRateLimitCooldown  = 60
+	DefaultKeyStrategy        = "balanced"
+	DefaultClientKeyMode      = "strip"
+	DefaultQuotaResetInterval = 60
+	DefaultKeyCheckInterval   = 6 * 3600
+	DefaultCachePruneInterval = 600
+	DefaultProbeInterval      = 300
+	DefaultProbeBackoff       = 600
+	DefaultProbeBackoffMax    = 24 * 3600
+	DefaultForecastWindow     = 7 * 24 * 3600
+	DefaultForecastInterval   = 3600
+	DefaultRefreshConcurrency = 8
+	DefaultRefreshTimeout     = 10
+	DefaultCacheBackend       = "memory"
+	DefaultCacheTTL           = 3600
+	DefaultCacheMaxEntries    = 1000
+)
+
+// Cache backends
+const (
+	CacheBackendMemory = "memory"
+	CacheBackendSQLite = "sqlite"
+	CacheBackendNone   = "none"
+)
+
+// Client key modes
+const (
+	ClientKeyModeStrip       = "strip"
+	ClientKeyModePassthrough = "passthrough"
+	ClientKeyModeToken       = "token"
 )
 
+// DefaultCacheRouteTTLs returns the default per-route cache TTLs
+// Account information and scans change between calls, so they are not cached
+func DefaultCacheRouteTTLs() map[string]int {
+	return map[string]int{
+		"/api-info":        0,
+		"/account/profile": 0,
+		"/shodan/scan":     0,
+		"/shodan/alert":    0,
+	}
+}
+
 // New creates a new configuration
 func New() (*Config, error) {
 	// Set default configuration
 	cfg := &Config{
-		Host:              DefaultHost,
-		Port:              DefaultPort,
-		APIHost:           DefaultAPIHost,
-		DatabasePath:      filepath.Join(DefaultDatabaseDir, "proxy.db"),
-		DefaultQuotaLimit: DefaultQuotaLimit,
-		CostPerRequest:    DefaultCostPerRequest,
+		Host:               DefaultHost,
+		Port:               DefaultPort,
+		APIHost:            DefaultAPIHost,
+		DatabasePath:       filepath.Join(DefaultDatabaseDir, "proxy.db"),
+		DefaultQuotaLimit:  DefaultQuotaLimit,
+		CostPerRequest:     DefaultCostPerRequest,
+		CostRules:          cost.DefaultRules(),
+		MaxAttempts:        DefaultMaxAttempts,
+		RateLimitCooldown:  DefaultRateLimitCooldown,
+		KeyStrategy:        DefaultKeyStrategy,
+		PoolStrategies:     map[string]string{},
+		ClientKeyMode:      DefaultClientKeyMode,
+		AccessTokens:       map[string]string{},
+		PlanCapabilities:   plan.DefaultCapabilities(),
+		QuotaResetInterval: DefaultQuotaResetInterval,
+		KeyCheckInterval:   DefaultKeyCheckInterval,
+		CachePruneInterval: DefaultCachePruneInterval,
+		ProbeInterval:      DefaultProbeInterval,
+		ProbeBackoff:       DefaultProbeBackoff,
+		ProbeBackoffMax:    DefaultProbeBackoffMax,
+		ForecastWindow:     DefaultForecastWindow,
+		ForecastInterval:   DefaultForecastInterval,
+		RefreshConcurrency: DefaultRefreshConcurrency,
+		RefreshTimeout:     DefaultRefreshTimeout,
+		CacheBackend:       DefaultCacheBackend,
+		CacheTTL:           DefaultCacheTTL,
+		CacheMaxEntries:    DefaultCacheMaxEntries,
+		CacheRouteTTLs:     DefaultCacheRouteTTLs(),
 	}
 
 	// Create data directory if it doesn't exist
@@ -66,6 +203,18 @@ func New() (*Config, error) {
 	return cfg, nil
 }
 
+// CacheTTLFor returns the cache TTL for the given path
+// The longest matching prefix in CacheRouteTTLs wins, otherwise CacheTTL is used
+func (c *Config) CacheTTLFor(path string) time.Duration {
+	ttl, matched := c.CacheTTL, ""
+	for prefix, routeTTL := range c.CacheRouteTTLs {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(matched) {
+			ttl, matched = routeTTL, prefix
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
 // configFilePath returns the path to the config file
 func (c *Config) configFilePath() string {
 	return filepath.Join(DefaultDatabaseDir, "config.json")
@@ -79,8 +228,34 @@ func (c *Config) loadFromFile() error {
 	}
 	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	return decoder.Decode(c)
+	return c.decode(file)
+}
+
+// decode reads the configuration from JSON over the current values
+// Maps set in the JSON replace the current ones instead of being merged
+// into them, so that default entries can be removed
+func (c *Config) decode(r io.Reader) error {
+	current := *c
+	c.PoolStrategies, c.AccessTokens, c.PlanCapabilities, c.CacheRouteTTLs = nil, nil, nil, nil
+
+	decoder := json.NewDecoder(r)
+	if err := decoder.Decode(c); err != nil {
+		return err
+	}
+
+	if c.PoolStrategies == nil {
+		c.PoolStrategies = current.PoolStrategies
+	}
+	if c.AccessTokens == nil {
+		c.AccessTokens = current.AccessTokens
+	}
+	if c.PlanCapabilities == nil {
+		c.PlanCapabilities = current.PlanCapabilities
+	}
+	if c.CacheRouteTTLs == nil {
+		c.CacheRouteTTLs = current.CacheRouteTTLs
+	}
+	return nil
 }
 
 // Save saves the configuration to a file
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"shodone/internal/plan"
+)
+
+func TestCacheTTLFor(t *testing.T) {
+	cfg := &Config{
+		CacheTTL: 3600,
+		CacheRouteTTLs: map[string]int{
+			"/shodan":             600,
+			"/shodan/host":        60,
+			"/shodan/host/search": 0,
+			"/api-info":           0,
+		},
+	}
+	tests := []struct {
+		path string
+		want time.Duration
+	}{
+		{"/dns/domain/example.com", time.Hour},
+		{"/shodan/ports", 10 * time.Minute},
+		{"/shodan/host/1.2.3.4", time.Minute},
+		{"/shodan/host/search", 0},
+		{"/shodan/host/search/facets", 0},
+		{"/api-info", 0},
+	}
+	for _, tt := range tests {
+		if got := cfg.CacheTTLFor(tt.path); got != tt.want {
+			t.Errorf("CacheTTLFor(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeReplacesDefaultMaps(t *testing.T) {
+	defaults := func() *Config {
+		return &Config{
+			Port:             DefaultPort,
+			KeyStrategy:      DefaultKeyStrategy,
+			PoolStrategies:   map[string]string{},
+			AccessTokens:     map[string]string{},
+			PlanCapabilities: plan.DefaultCapabilities(),
+			CacheRouteTTLs:   DefaultCacheRouteTTLs(),
+		}
+	}
+
+	t.Run("maps set in the file", func(t *testing.T) {
+		cfg := defaults()
+		err := cfg.decode(strings.NewReader(`{
+			"port": 9090,
+			"plan_capabilities": {"custom": ["scan"]},
+			"cache_route_ttls": {"/api-info": 60}
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPlans := map[string][]string{"custom": {"scan"}}
+		if !reflect.DeepEqual(cfg.PlanCapabilities, wantPlans) {
+			t.Errorf("plan_capabilities = %v, want %v", cfg.PlanCapabilities, wantPlans)
+		}
+		wantTTLs := map[string]int{"/api-info": 60}
+		if !reflect.DeepEqual(cfg.CacheRouteTTLs, wantTTLs) {
+			t.Errorf("cache_route_ttls = %v, want %v", cfg.CacheRouteTTLs, wantTTLs)
+		}
+		if cfg.Port != 9090 || cfg.KeyStrategy != DefaultKeyStrategy {
+			t.Errorf("port %d and strategy %q, want the file port and the default strategy", cfg.Port, cfg.KeyStrategy)
+		}
+	})
+
+	t.Run("empty maps in the file", func(t *testing.T) {
+		cfg := defaults()
+		if err := cfg.decode(strings.NewReader(`{"cache_route_ttls": {}}`)); err != nil {
+			t.Fatal(err)
+		}
+		if len(cfg.CacheRouteTTLs) != 0 {
+			t.Errorf("cache_route_ttls = %v, want none", cfg.CacheRouteTTLs)
+		}
+	})
+
+	t.Run("maps missing from the file", func(t *testing.T) {
+		cfg := defaults()
+		if err := cfg.decode(strings.NewReader(`{"port": 9090}`)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cfg.PlanCapabilities, plan.DefaultCapabilities()) {
+			t.Errorf("plan_capabilities = %v, want the defaults", cfg.PlanCapabilities)
+		}
+		if !reflect.DeepEqual(cfg.CacheRouteTTLs, DefaultCacheRouteTTLs()) {
+			t.Errorf("cache_route_ttls = %v, want the defaults", cfg.CacheRouteTTLs)
+		}
+		if cfg.PoolStrategies == nil || cfg.AccessTokens == nil {
+			t.Error("maps missing from the file were cleared")
+		}
+	})
+}
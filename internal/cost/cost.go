@@ -0,0 +1,183 @@
+package cost
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Kinds of Shodan credits a rule may charge
+const (
+	KindQuery = "query"
+	KindScan  = "scan"
+)
+
+// Conditions under which a rule charges its cost
+const (
+	// WhenAlways charges the cost on every request
+	WhenAlways = "always"
+	// WhenFiltersOrPaging charges the cost when the search query contains
+	// a filter or a page past the first one is requested
+	WhenFiltersOrPaging = "filters_or_paging"
+	// WhenPerIP charges the cost once per IP listed in the `ips` parameter
+	WhenPerIP = "per_ip"
+)
+
+// Rule describes the credit cost of requests matching a method and a path
+// Path is matched segment by segment and `*` matches any single segment
+type Rule struct {
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Cost   int    `json:"cost"`
+	When   string `json:"when,omitempty"`
+}
+
+// Cost is the amount of credits a request spends
+type Cost struct {
+	Query int `json:"query"`
+	Scan  int `json:"scan"`
+}
+
+// DefaultRules returns the credit rules of the Shodan REST API
+// Host lookups, counts and other unlisted endpoints are free
+func DefaultRules() []Rule {
+	return []Rule{
+		{Method: "GET", Path: "/shodan/host/count", Kind: KindQuery, Cost: 0},
+		{Method: "GET", Path: "/shodan/host/search", Kind: KindQuery, Cost: 1, When: WhenFiltersOrPaging},
+		{Method: "GET", Path: "/shodan/host/*", Kind: KindQuery, Cost: 0},
+		{Method: "POST", Path: "/shodan/scan", Kind: KindScan, Cost: 1, When: WhenPerIP},
+		{Method: "GET", Path: "/dns/domain/*", Kind: KindQuery, Cost: 1},
+	}
+}
+
+// Model works out the credit cost of requests from a list of rules
+type Model struct {
+	rules    []Rule
+	fallback int
+}
+
+// New creates a new cost model
+// The first matching rule wins, and requests matching no rule cost
+// fallback query credits
+func New(rules []Rule, fallback int) *Model {
+	return &Model{
+		rules:    rules,
+		fallback: fallback,
+	}
+}
+
+// Estimate returns the credits a request is going to spend
+func (m *Model) Estimate(method, path string, query url.Values, body []byte) Cost {
+	for _, rule := range m.rules {
+		if !rule.matches(method, path) {
+			continue
+		}
+
+		amount := 0
+		switch rule.When {
+		case WhenFiltersOrPaging:
+			if hasFilters(query.Get("query")) || page(query) > 1 {
+				amount = rule.Cost
+			}
+		case WhenPerIP:
+			amount = rule.Cost * countIPs(ipsParam(query, body))
+		default:
+			amount = rule.Cost
+		}
+
+		if rule.Kind == KindScan {
+			return Cost{Scan: amount}
+		}
+		return Cost{Query: amount}
+	}
+	return Cost{Query: m.fallback}
+}
+
+// matches reports whether the rule applies to the method and path
+func (r Rule) matches(method, path string) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, method) {
+		return false
+	}
+	patternSegments := strings.Split(strings.Trim(r.Path, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternSegments) != len(pathSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if segment != "*" && segment != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasFilters reports whether a search query contains a `name:value` filter
+func hasFilters(q string) bool {
+	for _, term := range strings.Fields(q) {
+		if i := strings.Index(term, ":"); i > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// page returns the requested result page, 1 if not set
+func page(query url.Values) int {
+	p, err := strconv.Atoi(query.Get("page"))
+	if err != nil || p < 1 {
+		return 1
+	}
+	return p
+}
+
+// ipsParam returns the `ips` parameter from the query or the form body
+func ipsParam(query url.Values, body []byte) string {
+	if ips := query.Get("ips"); ips != "" {
+		return ips
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return ""
+	}
+	return form.Get("ips")
+}
+
+// countIPs counts the addresses in a list of IPs and networks, at most MaxInt32
+// The list is either comma separated or a JSON object keyed by IP/network
+func countIPs(ips string) int {
+	var targets []string
+	var services map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(ips), &services); err == nil {
+		for target := range services {
+			targets = append(targets, target)
+		}
+	} else {
+		targets = strings.Split(ips, ",")
+	}
+
+	total := 0
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(target)
+		if err != nil {
+			total++
+			continue
+		}
+		ones, bits := network.Mask.Size()
+		if bits-ones >= 31 {
+			return math.MaxInt32
+		}
+		total += 1 << (bits - ones)
+		if total >= math.MaxInt32 {
+			return math.MaxInt32
+		}
+	}
+	return total
+}
@@ -0,0 +1,86 @@
+package cost
+
+import (
+	"math"
+	"net/url"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	model := New(DefaultRules(), 1)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		query  url.Values
+		body   string
+		want   Cost
+	}{
+		{"count is free", "GET", "/shodan/host/count", url.Values{"query": {"port:22"}}, "", Cost{}},
+		{"search without filters", "GET", "/shodan/host/search", url.Values{"query": {"apache"}}, "", Cost{}},
+		{"search with a filter", "GET", "/shodan/host/search", url.Values{"query": {"apache country:DE"}}, "", Cost{Query: 1}},
+		{"search past the first page", "GET", "/shodan/host/search", url.Values{"query": {"apache"}, "page": {"2"}}, "", Cost{Query: 1}},
+		{"search on the first page", "GET", "/shodan/host/search", url.Values{"query": {"apache"}, "page": {"1"}}, "", Cost{}},
+		{"search with an invalid page", "GET", "/shodan/host/search", url.Values{"query": {"apache"}, "page": {"x"}}, "", Cost{}},
+		{"colon at the start is no filter", "GET", "/shodan/host/search", url.Values{"query": {":apache"}}, "", Cost{}},
+		{"host lookup is free", "GET", "/shodan/host/1.2.3.4", nil, "", Cost{}},
+		{"host wildcard matches one segment", "GET", "/shodan/host/1.2.3.4/extra", nil, "", Cost{Query: 1}},
+		{"domain lookup", "GET", "/dns/domain/example.com", nil, "", Cost{Query: 1}},
+		{"method is case insensitive", "get", "/dns/domain/example.com", nil, "", Cost{Query: 1}},
+		{"other method falls back", "POST", "/shodan/host/count", nil, "", Cost{Query: 1}},
+		{"scan of query IPs", "POST", "/shodan/scan", url.Values{"ips": {"1.2.3.4,5.6.7.8"}}, "", Cost{Scan: 2}},
+		{"scan of body IPs", "POST", "/shodan/scan", nil, "ips=1.2.3.0%2F24", Cost{Scan: 256}},
+		{"scan without IPs", "POST", "/shodan/scan", nil, "", Cost{}},
+		{"unknown endpoint falls back", "GET", "/api-info", nil, "", Cost{Query: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := model.Estimate(tt.method, tt.path, tt.query, []byte(tt.body))
+			if got != tt.want {
+				t.Errorf("Estimate(%s %s) = %+v, want %+v", tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateFirstRuleWins(t *testing.T) {
+	model := New([]Rule{
+		{Path: "/shodan/host/search", Kind: KindQuery, Cost: 5},
+		{Path: "/shodan/host/*", Kind: KindQuery, Cost: 2},
+	}, 0)
+	if got := model.Estimate("GET", "/shodan/host/search", nil, nil); got != (Cost{Query: 5}) {
+		t.Errorf("Estimate(search) = %+v, want the first rule", got)
+	}
+	if got := model.Estimate("GET", "/shodan/host/1.2.3.4", nil, nil); got != (Cost{Query: 2}) {
+		t.Errorf("Estimate(host) = %+v, want the second rule", got)
+	}
+}
+
+func TestCountIPs(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  string
+		want int
+	}{
+		{"empty", "", 0},
+		{"single IP", "1.2.3.4", 1},
+		{"list with blanks", "1.2.3.4, ,5.6.7.8,", 2},
+		{"host network", "1.2.3.4/32", 1},
+		{"network", "1.2.3.0/24", 256},
+		{"IP and network", "1.2.3.4,10.0.0.0/30", 5},
+		{"JSON object", `{"1.2.3.4": [[80, "http"]], "10.0.0.0/31": []}`, 3},
+		{"largest uncapped network", "0.0.0.0/2", 1 << 30},
+		{"network reaching the cap", "0.0.0.0/1", math.MaxInt32},
+		{"networks summing past the cap", "0.0.0.0/2,64.0.0.0/2", math.MaxInt32},
+		{"IPv6 network", "2001:db8::/64", math.MaxInt32},
+		{"IPv6 host network", "2001:db8::1/128", 1},
+		{"unparsable entries count once", "example.com,1.2.3.4/99", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countIPs(tt.ips); got != tt.want {
+				t.Errorf("countIPs(%q) = %d, want %d", tt.ips, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package keyio
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"shodone/internal/client"
+	"shodone/internal/storage"
+)
+
+// Supported import and export formats
+const (
+	FormatText = "text" // one key per line
+	FormatCSV  = "csv"  // key, quota_limit, refreshes_at, label, tags, reset_rule, owner, notes, expires_at
+	FormatJSON = "json" // array of records
+)
+
+// csvHeader is the header of the CSV format
+// Tags are separated by semicolons in a single column
+var csvHeader = []string{"key", "quota_limit", "refreshes_at", "label", "tags", "reset_rule", "owner", "notes", "expires_at"}
+
+// Record is one key of an import or export
+type Record struct {
+	Key         string    `json:"key"`
+	QuotaLimit  int       `json:"quota_limit,omitempty"`
+	RefreshesAt time.Time `json:"refreshes_at,omitempty"`
+	Label       string    `json:"label,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	ResetRule   string    `json:"reset_rule,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Notes       string    `json:"notes,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitempty"`
+}
+
+// ParseFormat returns the format named by s, text if s is empty
+func ParseFormat(s string) (string, error) {
+	switch s {
+	case "", FormatText:
+		return FormatText, nil
+	case FormatCSV, FormatJSON:
+		return s, nil
+	}
+	return "", fmt.Errorf("unsupported format %q", s)
+}
+
+// FormatFromContentType guesses the format from a MIME type,
+// text for anything but CSV and JSON
+func FormatFromContentType(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "text/csv"):
+		return FormatCSV
+	case strings.HasPrefix(contentType, "application/json"):
+		return FormatJSON
+	}
+	return FormatText
+}
+
+// ContentType returns the MIME type of a format
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatJSON:
+		return "application/json"
+	}
+	return "text/plain"
+}
+
+// MaskKey masks an API key for display purposes
+func MaskKey(key string) string {
+	if len(key) < 4 {
+		return "****"
+	}
+	return key[:4] + "****"
+}
+
+// Parse reads the records of the given format from r
+func Parse(format string, r io.Reader) ([]Record, error) {
+	switch format {
+	case FormatText:
+		return parseText(r)
+	case FormatCSV:
+		return parseCSV(r)
+	case FormatJSON:
+		var records []Record
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON: %w", err)
+		}
+		return records, nil
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+// parseText reads one key per line, skipping blank lines and # comments
+func parseText(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		records = append(records, Record{Key: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// parseCSV reads the CSV format, with or without header
+// Without header, columns are in the order of csvHeader
+func parseCSV(r io.Reader) ([]Record, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSV: %w", err)
+	}
+
+	columns := csvHeader
+	if len(rows) > 0 && isCSVHeader(rows[0]) {
+		columns = rows[0]
+		rows = rows[1:]
+	}
+
+	var records []Record
+	for i, row := range rows {
+		var record Record
+		for j, value := range row {
+			if j >= len(columns) {
+				break
+			}
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			switch strings.ToLower(strings.TrimSpace(columns[j])) {
+			case "key":
+				record.Key = value
+			case "quota_limit":
+				if record.QuotaLimit, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid quota_limit %q", i+1, value)
+				}
+			case "refreshes_at":
+				if record.RefreshesAt, err = parseTime(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid refreshes_at %q", i+1, value)
+				}
+			case "label":
+				record.Label = value
+			case "tags":
+				record.Tags = strings.Split(value, ";")
+			case "reset_rule":
+				record.ResetRule = value
+			case "owner":
+				record.Owner = value
+			case "notes":
+				record.Notes = value
+			case "expires_at":
+				if record.ExpiresAt, err = parseTime(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid expires_at %q", i+1, value)
+				}
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// isCSVHeader reports whether a row is a header, which has a key column
+func isCSVHeader(row []string) bool {
+	for _, column := range row {
+		if strings.EqualFold(strings.TrimSpace(column), "key") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTime parses an RFC 3339 timestamp or a date
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// formatTime formats a timestamp as RFC 3339, empty if zero
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Write writes the records in the given format to w
+func Write(format string, w io.Writer, records []Record) error {
+	switch format {
+	case FormatText:
+		for _, record := range records {
+			if _, err := fmt.Fprintln(w, record.Key); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(csvHeader); err != nil {
+			return err
+		}
+		for _, record := range records {
+			row := []string{
+				record.Key, strconv.Itoa(record.QuotaLimit), formatTime(record.RefreshesAt),
+				record.Label, strings.Join(record.Tags, ";"), record.ResetRule,
+				record.Owner, record.Notes, formatTime(record.ExpiresAt),
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	}
+	return fmt.Errorf("unsupported format %q", format)
+}
+
+// FromAPIKeys converts stored keys to records, masking the keys unless unmasked is set
+func FromAPIKeys(keys []*storage.APIKey, unmasked bool) []Record {
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		record := Record{
+			Key:         key.Key,
+			QuotaLimit:  key.QuotaLimit,
+			RefreshesAt: key.RefreshesAt,
+			Label:       key.Label,
+			Tags:        key.Tags,
+			ResetRule:   key.ResetRule,
+			Owner:       key.Owner,
+			Notes:       key.Notes,
+			ExpiresAt:   key.ExpiresAt,
+		}
+		if !unmasked {
+			record.Key = MaskKey(record.Key)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// Import outcomes of a record
+const (
+	StatusAdded     = "added"
+	StatusDuplicate = "duplicate"
+	StatusInvalid   = "invalid"
+	StatusFailed    = "failed"
+)
+
+// Result reports the outcome of importing one record
+type Result struct {
+	Row    int    `json:"row"`
+	Key    string `json:"key"`
+	ID     int    `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Importer adds records to the database one by one
+type Importer struct {
+	DB                *storage.DB
+	DefaultQuotaLimit int
+	// Validate, if set, is called before adding each key, and keys it
+	// returns an error for are skipped, as invalid if client.IsInvalidKey
+	// holds for the error and as failed otherwise
+	// The account information it returns, if any, sets the quota limit
+	// of records without one and is stored with the added key
+	Validate func(key string) (*client.KeyInfo, error)
+}
+
+// Import adds the records and reports the outcome of each of them
+func (im *Importer) Import(records []Record) []Result {
+	results := make([]Result, 0, len(records))
+	for i, record := range records {
+		result := Result{
+			Row: i + 1,
+			Key: MaskKey(record.Key),
+		}
+		id, err := im.importRecord(record)
+		switch {
+		case err == nil:
+			result.ID = id
+			result.Status = StatusAdded
+		case errors.Is(err, storage.ErrDuplicateKey):
+			result.Status = StatusDuplicate
+			result.Error = err.Error()
+		case errors.Is(err, errInvalidKey):
+			result.Status = StatusInvalid
+			result.Error = err.Error()
+		default:
+			result.Status = StatusFailed
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// errInvalidKey wraps the errors returned by Importer.Validate
+var errInvalidKey = errors.New("invalid API key")
+
+// importRecord adds one record
+func (im *Importer) importRecord(record Record) (int, error) {
+	record.Key = strings.TrimSpace(record.Key)
+	if record.Key == "" {
+		return 0, fmt.Errorf("%w: empty key", errInvalidKey)
+	}
+	if _, err := storage.ParseResetRule(record.ResetRule); err != nil {
+		return 0, err
+	}
+	// Skip the check of keys already stored
+	exists, err := im.DB.HasAPIKey(record.Key)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, storage.ErrDuplicateKey
+	}
+	var info *client.KeyInfo
+	if im.Validate != nil {
+		if info, err = im.Validate(record.Key); err != nil {
+			if client.IsInvalidKey(err) {
+				return 0, fmt.Errorf("%w: %v", errInvalidKey, err)
+			}
+			return 0, fmt.Errorf("failed to check key: %w", err)
+		}
+	}
+	if record.QuotaLimit <= 0 && info != nil {
+		record.QuotaLimit = info.QuotaLimit()
+	}
+	if record.QuotaLimit <= 0 {
+		record.QuotaLimit = im.DefaultQuotaLimit
+	}
+	id, err := im.DB.AddAPIKey(storage.NewAPIKey{
+		Key:         record.Key,
+		QuotaLimit:  record.QuotaLimit,
+		RefreshesAt: record.RefreshesAt,
+		ResetRule:   record.ResetRule,
+		Label:       record.Label,
+		Owner:       record.Owner,
+		Notes:       record.Notes,
+		ExpiresAt:   record.ExpiresAt,
+		Tags:        record.Tags,
+	})
+	if err != nil || info == nil {
+		return id, err
+	}
+	return id, im.DB.StoreAPIKeyInfo(id, record.QuotaLimit, info)
+}
+
+// Count returns how many results have the given status
+func Count(results []Result, status string) int {
+	var count int
+	for _, result := range results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,122 @@
+package keyio
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCSV(t *testing.T) {
+	refreshes := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	expires := time.Date(2027, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		input string
+		want  []Record
+	}{
+		{
+			name:  "without header",
+			input: "ABC,100,2026-11-01,main,a;b,monthly:15,alice,spare,2027-01-01T12:00:00Z\nDEF\n",
+			want: []Record{
+				{Key: "ABC", QuotaLimit: 100, RefreshesAt: refreshes, Label: "main", Tags: []string{"a", "b"},
+					ResetRule: "monthly:15", Owner: "alice", Notes: "spare", ExpiresAt: expires},
+				{Key: "DEF"},
+			},
+		},
+		{
+			name:  "with header in another order",
+			input: "label, Key ,tags\nmain,ABC,a\n,DEF,\n",
+			want: []Record{
+				{Key: "ABC", Label: "main", Tags: []string{"a"}},
+				{Key: "DEF"},
+			},
+		},
+		{
+			name:  "header case insensitive",
+			input: "KEY,QUOTA_LIMIT\nABC,5\n",
+			want:  []Record{{Key: "ABC", QuotaLimit: 5}},
+		},
+		{
+			name:  "unknown and extra columns ignored",
+			input: "key,color\nABC,red,extra\n",
+			want:  []Record{{Key: "ABC"}},
+		},
+		{
+			name:  "comments and blank lines skipped",
+			input: "# keys\n\n  ABC , 10\n",
+			want:  []Record{{Key: "ABC", QuotaLimit: 10}},
+		},
+		{
+			name:  "empty",
+			input: "",
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCSV(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("parseCSV: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCSV = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCSVErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{"invalid quota", "ABC,lots\n", "row 1: invalid quota_limit"},
+		{"invalid refresh time", "key,refreshes_at\nABC,2026-11-01\nDEF,soon\n", "row 2: invalid refreshes_at"},
+		{"invalid expiry", "key,expires_at\nABC,tomorrow\n", "row 1: invalid expires_at"},
+		{"unbalanced quotes", "\"ABC,1\n", "failed to parse CSV"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseCSV(strings.NewReader(tt.input))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseCSV error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseText(t *testing.T) {
+	got, err := Parse(FormatText, strings.NewReader("ABC\n\n# comment\n  DEF  \n"))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := []Record{{Key: "ABC"}, {Key: "DEF"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteParseRoundTrip(t *testing.T) {
+	records := []Record{
+		{Key: "ABC", QuotaLimit: 100, RefreshesAt: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+			Label: "main", Tags: []string{"a", "b"}, ResetRule: "interval:30d", Owner: "alice",
+			Notes: "shared, read-only", ExpiresAt: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Key: "DEF"},
+	}
+	for _, format := range []string{FormatCSV, FormatJSON} {
+		var buf bytes.Buffer
+		if err := Write(format, &buf, records); err != nil {
+			t.Fatalf("Write(%s): %v", format, err)
+		}
+		got, err := Parse(format, &buf)
+		if err != nil {
+			t.Fatalf("Parse(%s): %v", format, err)
+		}
+		if !reflect.DeepEqual(got, records) {
+			t.Errorf("%s round trip = %+v, want %+v", format, got, records)
+		}
+	}
+}
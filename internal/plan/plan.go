@@ -0,0 +1,107 @@
+package plan
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Capabilities of Shodan plans needed by some endpoints and filters
+const (
+	CapabilityScan       = "scan"
+	CapabilityBulkData   = "bulk_data"
+	CapabilityStream     = "stream"
+	CapabilityVulnFilter = "vuln_filter"
+	CapabilityTagFilter  = "tag_filter"
+)
+
+// DefaultCapabilities returns the capabilities unlocked by each plan,
+// keyed by the `plan` reported by /api-info
+func DefaultCapabilities() map[string][]string {
+	return map[string][]string{
+		"oss":        {},
+		"dev":        {CapabilityScan},
+		"basic":      {CapabilityScan},
+		"edu":        {CapabilityScan, CapabilityVulnFilter},
+		"plus":       {CapabilityScan, CapabilityVulnFilter},
+		"corp":       {CapabilityScan, CapabilityVulnFilter, CapabilityTagFilter, CapabilityBulkData, CapabilityStream},
+		"stream-100": {CapabilityScan, CapabilityVulnFilter, CapabilityTagFilter, CapabilityStream},
+		"enterprise": {CapabilityScan, CapabilityVulnFilter, CapabilityTagFilter, CapabilityBulkData, CapabilityStream},
+	}
+}
+
+// streamPaths lists the endpoints of the Shodan stream API
+var streamPaths = []string{
+	"/shodan/banners",
+	"/shodan/asn/",
+	"/shodan/countries/",
+	"/shodan/tags/",
+	"/shodan/vulns/",
+	"/shodan/custom",
+}
+
+// filterCapabilities maps search filters to the capability they need
+var filterCapabilities = map[string]string{
+	"vuln": CapabilityVulnFilter,
+	"tag":  CapabilityTagFilter,
+}
+
+// Required returns the capabilities a request needs
+func Required(method, path string, query url.Values) []string {
+	var required []string
+	if method == "POST" && strings.HasPrefix(path, "/shodan/scan") {
+		required = append(required, CapabilityScan)
+	}
+	if strings.HasPrefix(path, "/shodan/data") {
+		required = append(required, CapabilityBulkData)
+	}
+	for _, prefix := range streamPaths {
+		if strings.HasPrefix(path, prefix) {
+			required = append(required, CapabilityStream)
+			break
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, term := range strings.Fields(query.Get("query")) {
+		name, _, found := strings.Cut(strings.TrimPrefix(term, "-"), ":")
+		if !found {
+			continue
+		}
+		capability, ok := filterCapabilities[strings.ToLower(name)]
+		if ok && !seen[capability] {
+			seen[capability] = true
+			required = append(required, capability)
+		}
+	}
+	return required
+}
+
+// Supporting returns the plans of the table that have all the required capabilities
+func Supporting(table map[string][]string, required []string) []string {
+	plans := []string{}
+	for name, capabilities := range table {
+		if hasAll(capabilities, required) {
+			plans = append(plans, name)
+		}
+	}
+	sort.Strings(plans)
+	return plans
+}
+
+// hasAll reports whether capabilities contains every required capability
+func hasAll(capabilities, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, c := range capabilities {
+			if c == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
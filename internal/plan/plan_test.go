@@ -0,0 +1,63 @@
+package plan
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		query  string
+		want   []string
+	}{
+		{"host lookup", "GET", "/shodan/host/1.2.3.4", "", nil},
+		{"plain search", "GET", "/shodan/host/search", "apache port:80", nil},
+		{"scan", "POST", "/shodan/scan", "", []string{CapabilityScan}},
+		{"internet scan", "POST", "/shodan/scan/internet", "", []string{CapabilityScan}},
+		{"scan status", "GET", "/shodan/scan/ABC", "", nil},
+		{"bulk data", "GET", "/shodan/data/dataset", "", []string{CapabilityBulkData}},
+		{"stream banners", "GET", "/shodan/banners", "", []string{CapabilityStream}},
+		{"stream by ASN", "GET", "/shodan/asn/3303,32475", "", []string{CapabilityStream}},
+		{"vuln filter", "GET", "/shodan/host/search", "apache vuln:CVE-2021-44228", []string{CapabilityVulnFilter}},
+		{"negated tag filter", "GET", "/shodan/host/search", "-tag:ics", []string{CapabilityTagFilter}},
+		{"uppercase filter", "GET", "/shodan/host/count", "VULN:CVE-2014-0160", []string{CapabilityVulnFilter}},
+		{"repeated filter", "GET", "/shodan/host/search", "vuln:a vuln:b tag:c", []string{CapabilityVulnFilter, CapabilityTagFilter}},
+		{"filter name in a value", "GET", "/shodan/host/search", "title:vuln", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Required(tt.method, tt.path, url.Values{"query": {tt.query}})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Required = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSupporting(t *testing.T) {
+	table := DefaultCapabilities()
+	tests := []struct {
+		name     string
+		required []string
+		want     []string
+	}{
+		{"nothing required", nil, []string{"basic", "corp", "dev", "edu", "enterprise", "oss", "plus", "stream-100"}},
+		{"scan", []string{CapabilityScan}, []string{"basic", "corp", "dev", "edu", "enterprise", "plus", "stream-100"}},
+		{"bulk data", []string{CapabilityBulkData}, []string{"corp", "enterprise"}},
+		{"stream", []string{CapabilityStream}, []string{"corp", "enterprise", "stream-100"}},
+		{"vuln filter", []string{CapabilityVulnFilter}, []string{"corp", "edu", "enterprise", "plus", "stream-100"}},
+		{"vuln and tag filters", []string{CapabilityVulnFilter, CapabilityTagFilter}, []string{"corp", "enterprise", "stream-100"}},
+		{"unknown capability", []string{"teleport"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Supporting(table, tt.required); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Supporting(%v) = %v, want %v", tt.required, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// CachedResponse represents a row of the response cache
+type CachedResponse struct {
+	Key        string
+	StatusCode int
+	Header     []byte
+	Body       []byte
+	ExpiresAt  time.Time
+}
+
+// GetCachedResponse gets a cached response that has not expired at now
+// It returns nil without error if there is no such response
+func (d *DB) GetCachedResponse(key string, now time.Time) (*CachedResponse, error) {
+	var cached CachedResponse
+	err := d.db.QueryRow(`
+		SELECT key, status_code, header, body, expires_at
+		FROM response_cache
+		WHERE key = ?
+	`, key).Scan(
+		&cached.Key, &cached.StatusCode, &cached.Header, &cached.Body, &cached.ExpiresAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cached.ExpiresAt.Before(now) {
+		if _, err := d.db.Exec("DELETE FROM response_cache WHERE key = ?", key); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	return &cached, nil
+}
+
+// SetCachedResponse inserts or replaces a cached response
+func (d *DB) SetCachedResponse(cached *CachedResponse) error {
+	_, err := d.db.Exec(
+		"INSERT OR REPLACE INTO response_cache (key, status_code, header, body, expires_at) VALUES (?, ?, ?, ?, ?)",
+		cached.Key, cached.StatusCode, cached.Header, cached.Body, cached.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+// PruneCachedResponses deletes the cached responses expired at now, then the
+// ones expiring first beyond maxEntries if it is positive
+// It returns the number of deleted responses
+func (d *DB) PruneCachedResponses(now time.Time, maxEntries int) (int, error) {
+	res, err := d.db.Exec("DELETE FROM response_cache WHERE expires_at <= ?", now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	expired, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if maxEntries <= 0 {
+		return int(expired), nil
+	}
+
+	res, err = d.db.Exec(`
+		DELETE FROM response_cache
+		WHERE key NOT IN (
+			SELECT key FROM response_cache ORDER BY expires_at DESC LIMIT ?
+		)
+	`, maxEntries)
+	if err != nil {
+		return 0, err
+	}
+	evicted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(expired + evicted), nil
+}
+
+// PurgeCachedResponses deletes all cached responses
+func (d *DB) PurgeCachedResponses() error {
+	_, err := d.db.Exec("DELETE FROM response_cache")
+	return err
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix marks key material encrypted with a master key
+const encryptedPrefix = "enc:v1:"
+
+// errNoMasterKey is returned when reading encrypted keys without a master key
+var errNoMasterKey = errors.New("API key is encrypted but no master key is configured")
+
+// Cipher encrypts API keys with AES-256-GCM
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher creates a new cipher from a 32 bytes master key
+func NewCipher(masterKey []byte) (*Cipher, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(masterKey))
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// ParseMasterKey decodes a hex or base64 encoded 32 bytes master key
+func ParseMasterKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("master key must be 32 bytes encoded in hex or base64")
+}
+
+// Encrypt encrypts a key, with a random nonce prepended to the ciphertext
+func (c *Cipher) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a key produced by Encrypt
+func (c *Cipher) Decrypt(stored string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode encrypted key: %w", err)
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return "", errors.New("encrypted key is too short")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt key, wrong master key? %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// isEncrypted reports whether stored key material is encrypted
+func isEncrypted(stored string) bool {
+	return strings.HasPrefix(stored, encryptedPrefix)
+}
+
+// hashKey returns the lookup hash of a key, used to detect duplicates
+// without decrypting every row
+// Shodan keys are long random strings, so an unsalted hash does not leak them
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// sealKey returns the key material to store, encrypted if a master key is set
+func (d *DB) sealKey(key string) (string, error) {
+	if d.cipher == nil {
+		return key, nil
+	}
+	return d.cipher.Encrypt(key)
+}
+
+// openKey returns the plaintext of stored key material
+func (d *DB) openKey(stored string) (string, error) {
+	if !isEncrypted(stored) {
+		return stored, nil
+	}
+	if d.cipher == nil {
+		return "", errNoMasterKey
+	}
+	return d.cipher.Decrypt(stored)
+}
+
+// migrateKeys checks that every key can be decrypted, fills their lookup
+// hash and, if a master key is set, encrypts the keys still in plaintext
+func (d *DB) migrateKeys() error {
+	rows, err := d.db.Query("SELECT id, key, key_hash FROM api_keys")
+	if err != nil {
+		return err
+	}
+	type storedKey struct {
+		id      int
+		key     string
+		hasHash bool
+	}
+	var keys []storedKey
+	for rows.Next() {
+		var k storedKey
+		var keyHash *string
+		if err := rows.Scan(&k.id, &k.key, &keyHash); err != nil {
+			rows.Close()
+			return err
+		}
+		k.hasHash = keyHash != nil
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var encrypted int
+	for _, k := range keys {
+		// Open every key, so a missing or wrong master key fails early
+		plaintext, err := d.openKey(k.key)
+		if err != nil {
+			return fmt.Errorf("key %d: %w", k.id, err)
+		}
+		needsEncryption := d.cipher != nil && !isEncrypted(k.key)
+		if k.hasHash && !needsEncryption {
+			continue
+		}
+		sealed, err := d.sealKey(plaintext)
+		if err != nil {
+			return fmt.Errorf("key %d: %w", k.id, err)
+		}
+		if _, err := tx.Exec(
+			"UPDATE api_keys SET key = ?, key_hash = ? WHERE id = ?",
+			sealed, hashKey(plaintext), k.id,
+		); err != nil {
+			return err
+		}
+		if needsEncryption {
+			encrypted++
+		}
+	}
+
+	if _, err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_key_hash ON api_keys (key_hash)"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if encrypted == 0 {
+		return nil
+	}
+	return d.compact()
+}
+
+// RotateMasterKey re-encrypts every key with a new master key
+// A nil master key decrypts the keys back to plaintext
+func (d *DB) RotateMasterKey(newMasterKey []byte) error {
+	var newCipher *Cipher
+	if newMasterKey != nil {
+		var err error
+		if newCipher, err = NewCipher(newMasterKey); err != nil {
+			return err
+		}
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, key FROM api_keys")
+	if err != nil {
+		return err
+	}
+	sealed := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var stored string
+		if err := rows.Scan(&id, &stored); err != nil {
+			rows.Close()
+			return err
+		}
+		plaintext, err := d.openKey(stored)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("key %d: %w", id, err)
+		}
+		if newCipher == nil {
+			sealed[id] = plaintext
+			continue
+		}
+		if sealed[id], err = newCipher.Encrypt(plaintext); err != nil {
+			rows.Close()
+			return fmt.Errorf("key %d: %w", id, err)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, key := range sealed {
+		if _, err := tx.Exec("UPDATE api_keys SET key = ? WHERE id = ?", key, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	d.cipher = newCipher
+	return d.compact()
+}
+
+// compact rebuilds the database file and empties the WAL, so that key
+// material replaced by a migration or rotation is left neither in old
+// pages nor in the log
+func (d *DB) compact() error {
+	if _, err := d.db.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	if _, err := d.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fmt.Errorf("failed to checkpoint database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testMasterKey returns a 32 bytes master key filled with b
+func testMasterKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// openTestDB opens the database at path, closing it at the end of the test
+func openTestDB(t *testing.T, path string, masterKey []byte) *DB {
+	t.Helper()
+	db, err := New(path, masterKey)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// storedKeys returns the raw key column of every key by ID
+func storedKeys(t *testing.T, db *DB) map[int]string {
+	t.Helper()
+	rows, err := db.db.Query("SELECT id, key FROM api_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	keys := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var key string
+		if err := rows.Scan(&id, &key); err != nil {
+			t.Fatal(err)
+		}
+		keys[id] = key
+	}
+	return keys
+}
+
+// assertNotInFiles fails if any of the secrets appears in the files of dir,
+// which include the database, its WAL and shared memory
+func assertNotInFiles(t *testing.T, dir string, secrets []string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range secrets {
+			if bytes.Contains(data, []byte(secret)) {
+				t.Errorf("%s still contains key %s", entry.Name(), secret)
+			}
+		}
+	}
+}
+
+// testSecrets are plaintext keys easy to grep for
+var testSecrets = []string{
+	"PLAINTEXTKEYAAAAAAAAAAAAAAAAAAAA",
+	"PLAINTEXTKEYBBBBBBBBBBBBBBBBBBBB",
+	"PLAINTEXTKEYCCCCCCCCCCCCCCCCCCCC",
+	"PLAINTEXTKEYDDDDDDDDDDDDDDDDDDDD",
+	"PLAINTEXTKEYEEEEEEEEEEEEEEEEEEEE",
+}
+
+// addTestSecrets adds testSecrets to db and returns their IDs
+func addTestSecrets(t *testing.T, db *DB) []int {
+	t.Helper()
+	var ids []int
+	for _, secret := range testSecrets {
+		id, err := db.AddAPIKey(NewAPIKey{Key: secret, QuotaLimit: 100})
+		if err != nil {
+			t.Fatalf("AddAPIKey: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// assertKeysReadable fails unless every test secret reads back from db
+func assertKeysReadable(t *testing.T, db *DB, ids []int) {
+	t.Helper()
+	for i, id := range ids {
+		key, err := db.GetAPIKey(id)
+		if err != nil {
+			t.Fatalf("GetAPIKey(%d): %v", id, err)
+		}
+		if key.Key != testSecrets[i] {
+			t.Errorf("key %d = %q, want %q", id, key.Key, testSecrets[i])
+		}
+	}
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	c, err := NewCipher(testMasterKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"", "ABCDEF", strings.Repeat("k", 1000)} {
+		sealed, err := c.Encrypt(plaintext)
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		if !isEncrypted(sealed) || (plaintext != "" && strings.Contains(sealed, plaintext)) {
+			t.Errorf("Encrypt(%q) = %q, want it sealed", plaintext, sealed)
+		}
+		got, err := c.Decrypt(sealed)
+		if err != nil || got != plaintext {
+			t.Errorf("Decrypt(Encrypt(%q)) = %q, %v", plaintext, got, err)
+		}
+	}
+
+	// Random nonces make every encryption different
+	a, _ := c.Encrypt("ABCDEF")
+	b, _ := c.Encrypt("ABCDEF")
+	if a == b {
+		t.Error("Encrypt returned the same ciphertext twice")
+	}
+}
+
+func TestCipherDecryptErrors(t *testing.T) {
+	c, _ := NewCipher(testMasterKey(1))
+	other, _ := NewCipher(testMasterKey(2))
+	sealed, _ := c.Encrypt("ABCDEF")
+
+	if _, err := other.Decrypt(sealed); err == nil {
+		t.Error("Decrypt with the wrong master key succeeded")
+	}
+	if _, err := c.Decrypt(encryptedPrefix + "not base64!"); err == nil {
+		t.Error("Decrypt of invalid base64 succeeded")
+	}
+	if _, err := c.Decrypt(encryptedPrefix + "AAAA"); err == nil {
+		t.Error("Decrypt of a too short ciphertext succeeded")
+	}
+	if _, err := NewCipher(testMasterKey(1)[:16]); err == nil {
+		t.Error("NewCipher with a 16 bytes master key succeeded")
+	}
+}
+
+func TestParseMasterKey(t *testing.T) {
+	want := testMasterKey(0xab)
+	for _, encoded := range []string{
+		strings.Repeat("ab", 32),
+		" " + strings.Repeat("AB", 32) + "\n",
+		"q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s=",
+	} {
+		got, err := ParseMasterKey(encoded)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("ParseMasterKey(%q) = %x, %v", encoded, got, err)
+		}
+	}
+	if _, err := ParseMasterKey("abcd"); err == nil {
+		t.Error("ParseMasterKey of a short key succeeded")
+	}
+}
+
+func TestMigrateKeysEncryptsPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shodone.db")
+
+	plain := openTestDB(t, path, nil)
+	ids := addTestSecrets(t, plain)
+	plain.Close()
+
+	db := openTestDB(t, path, testMasterKey(1))
+	for id, stored := range storedKeys(t, db) {
+		if !strings.HasPrefix(stored, encryptedPrefix) {
+			t.Errorf("key %d stored as %q, want %s prefix", id, stored, encryptedPrefix)
+		}
+	}
+	assertKeysReadable(t, db, ids)
+
+	// Duplicates are still detected through the key hash
+	if _, err := db.AddAPIKey(NewAPIKey{Key: testSecrets[0]}); err != ErrDuplicateKey {
+		t.Errorf("AddAPIKey of a migrated key = %v, want ErrDuplicateKey", err)
+	}
+	db.Close()
+
+	assertNotInFiles(t, dir, testSecrets)
+
+	// Reopening without the master key or with another one fails
+	if db, err := New(path, nil); err == nil {
+		db.Close()
+		t.Error("New without master key succeeded on encrypted keys")
+	}
+	if db, err := New(path, testMasterKey(2)); err == nil {
+		db.Close()
+		t.Error("New with the wrong master key succeeded")
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shodone.db")
+
+	db := openTestDB(t, path, testMasterKey(1))
+	ids := addTestSecrets(t, db)
+	before := storedKeys(t, db)
+
+	// Rotate to a new master key
+	if err := db.RotateMasterKey(testMasterKey(2)); err != nil {
+		t.Fatalf("RotateMasterKey: %v", err)
+	}
+	for id, stored := range storedKeys(t, db) {
+		if !isEncrypted(stored) || stored == before[id] {
+			t.Errorf("key %d not re-encrypted: %q", id, stored)
+		}
+	}
+	assertKeysReadable(t, db, ids)
+	db.Close()
+
+	var oldCiphertexts []string
+	for _, stored := range before {
+		oldCiphertexts = append(oldCiphertexts, strings.TrimPrefix(stored, encryptedPrefix))
+	}
+	assertNotInFiles(t, dir, oldCiphertexts)
+
+	if db, err := New(path, testMasterKey(1)); err == nil {
+		db.Close()
+		t.Error("New with the old master key succeeded after rotation")
+	}
+
+	// Decrypt back to plaintext
+	db = openTestDB(t, path, testMasterKey(2))
+	if err := db.RotateMasterKey(nil); err != nil {
+		t.Fatalf("RotateMasterKey(nil): %v", err)
+	}
+	for i, id := range ids {
+		if stored := storedKeys(t, db)[id]; stored != testSecrets[i] {
+			t.Errorf("key %d stored as %q, want plaintext", id, stored)
+		}
+	}
+	db.Close()
+
+	db = openTestDB(t, path, nil)
+	assertKeysReadable(t, db, ids)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// RequestLog represents a log entry for a proxied request
+type RequestLog struct {
+	ID           int       `json:"id"`
+	Timestamp    time.Time `json:"timestamp"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Query        string    `json:"query"` // Normalized, without the key
+	StatusCode   int       `json:"status_code"`
+	KeyID        int       `json:"key_id"` // 0 if no key served the request
+	QueryCredits int       `json:"query_credits"`
+	ScanCredits  int       `json:"scan_credits"`
+	LatencyMs    int64     `json:"latency_ms"`
+	Bytes        int       `json:"bytes"`
+	Client       string    `json:"client"`
+	Cached       bool      `json:"cached"`      // Answered from the response cache
+	FailedOver   bool      `json:"failed_over"` // Key rejected by the upstream, retried with another key
+}
+
+// LogFilter narrows down the requests GetRequestLogs returns
+// Zero fields are not filtered on
+type LogFilter struct {
+	From   time.Time
+	To     time.Time
+	KeyID  int
+	Status int
+	Path   string // Path prefix
+	Limit  int
+	Offset int
+}
+
+// where returns the SQL conditions and arguments of the filter
+func (f LogFilter) where() (string, []any) {
+	conds := []string{"TRUE"}
+	var args []any
+	if !f.From.IsZero() {
+		conds = append(conds, "timestamp >= ?")
+		args = append(args, f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "timestamp < ?")
+		args = append(args, f.To.UTC())
+	}
+	if f.KeyID != 0 {
+		conds = append(conds, "key_id = ?")
+		args = append(args, f.KeyID)
+	}
+	if f.Status != 0 {
+		conds = append(conds, "status_code = ?")
+		args = append(args, f.Status)
+	}
+	if f.Path != "" {
+		conds = append(conds, "substr(path, 1, ?) = ?")
+		args = append(args, len(f.Path), f.Path)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// LogRequest logs a proxied request, timestamped now if not set
+func (d *DB) LogRequest(entry *RequestLog) error {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	var keyID any
+	if entry.KeyID != 0 {
+		keyID = entry.KeyID
+	}
+	_, err := d.db.Exec(`
+		INSERT INTO request_log (
+			timestamp, method, path, query, status_code, key_id,
+			query_credits, scan_credits, latency_ms, bytes, client, cached, failed_over
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		entry.Timestamp.UTC(), entry.Method, entry.Path, entry.Query, entry.StatusCode, keyID,
+		entry.QueryCredits, entry.ScanCredits, entry.LatencyMs, entry.Bytes, entry.Client, entry.Cached,
+		entry.FailedOver,
+	)
+	return err
+}
+
+// GetRequestLogs gets the logged requests matching filter, most recent first,
+// and how many match in total regardless of the limit and offset
+func (d *DB) GetRequestLogs(filter LogFilter) ([]*RequestLog, int, error) {
+	where, args := filter.where()
+
+	var total int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM request_log WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := d.db.Query(`
+		SELECT id, timestamp, method, path, query, status_code, key_id,
+		       query_credits, scan_credits, latency_ms, bytes, client, cached, failed_over
+		FROM request_log
+		WHERE `+where+`
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	logs := []*RequestLog{}
+	for rows.Next() {
+		var entry RequestLog
+		var statusCode, keyID sql.NullInt64
+		err := rows.Scan(
+			&entry.ID, &entry.Timestamp, &entry.Method, &entry.Path, &entry.Query, &statusCode, &keyID,
+			&entry.QueryCredits, &entry.ScanCredits, &entry.LatencyMs, &entry.Bytes, &entry.Client, &entry.Cached,
+			&entry.FailedOver,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		entry.StatusCode = int(statusCode.Int64)
+		entry.KeyID = int(keyID.Int64)
+		logs = append(logs, &entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return logs, total, nil
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of quota reset rules
+const (
+	// ResetMonthly resets the quota on a day of each month
+	ResetMonthly = "monthly"
+	// ResetInterval resets the quota after a fixed interval
+	ResetInterval = "interval"
+	// ResetNever never resets the quota
+	ResetNever = "never"
+	// ResetAuto resets the quota when /api-info shows credits jumping back up
+	ResetAuto = "auto"
+)
+
+// ResetRule is when the quota of a key resets
+// It is written monthly:DAY, interval:DURATION (e.g. 30d, 12h), never or auto
+type ResetRule struct {
+	Kind     string
+	Day      int           // Day of month of monthly rules
+	Interval time.Duration // Interval of interval rules
+}
+
+// maxResetInterval bounds interval rules to about a century
+const maxResetInterval = 100 * 365 * 24 * time.Hour
+
+// DefaultResetRule resets the quota on the 1st of each month
+var DefaultResetRule = ResetRule{Kind: ResetMonthly, Day: 1}
+
+// ParseResetRule parses a reset rule, the default rule if s is empty
+func ParseResetRule(s string) (ResetRule, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return DefaultResetRule, nil
+	}
+
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case ResetNever, ResetAuto:
+		if arg != "" {
+			return ResetRule{}, fmt.Errorf("reset rule %q takes no argument", kind)
+		}
+		return ResetRule{Kind: kind}, nil
+	case ResetMonthly:
+		if arg == "" {
+			return DefaultResetRule, nil
+		}
+		day, err := strconv.Atoi(arg)
+		if err != nil || day < 1 || day > 31 {
+			return ResetRule{}, fmt.Errorf("invalid day of month %q", arg)
+		}
+		return ResetRule{Kind: ResetMonthly, Day: day}, nil
+	case ResetInterval:
+		interval, err := parseInterval(arg)
+		if err != nil || interval <= 0 || interval > maxResetInterval {
+			return ResetRule{}, fmt.Errorf("invalid reset interval %q", arg)
+		}
+		return ResetRule{Kind: ResetInterval, Interval: interval}, nil
+	}
+	return ResetRule{}, fmt.Errorf("unknown reset rule %q", s)
+}
+
+// parseInterval parses a duration, which may also be a number of days like 30d
+func parseInterval(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		// Bound the day count before multiplying so that it cannot overflow
+		if n < 0 || n > int(maxResetInterval/(24*time.Hour)) {
+			return 0, fmt.Errorf("interval of %d days out of range", n)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// String formats the rule as parsed by ParseResetRule
+func (r ResetRule) String() string {
+	switch r.Kind {
+	case ResetMonthly:
+		return fmt.Sprintf("%s:%d", ResetMonthly, r.Day)
+	case ResetInterval:
+		switch {
+		case r.Interval%(24*time.Hour) == 0:
+			return fmt.Sprintf("%s:%dd", ResetInterval, r.Interval/(24*time.Hour))
+		case r.Interval%time.Hour == 0:
+			return fmt.Sprintf("%s:%dh", ResetInterval, r.Interval/time.Hour)
+		case r.Interval%time.Minute == 0:
+			return fmt.Sprintf("%s:%dm", ResetInterval, r.Interval/time.Minute)
+		}
+		return fmt.Sprintf("%s:%s", ResetInterval, r.Interval)
+	}
+	return r.Kind
+}
+
+// Next returns the first reset after now, given the last scheduled one
+// (zero if unknown), or zero if the rule has no schedule
+// Use UTC to avoid some potential issues
+func (r ResetRule) Next(last, now time.Time) time.Time {
+	now = now.UTC()
+	switch r.Kind {
+	case ResetMonthly:
+		next := monthDay(now.Year(), now.Month(), r.Day)
+		if !next.After(now) {
+			next = monthDay(now.Year(), now.Month()+1, r.Day)
+		}
+		return next
+	case ResetInterval:
+		if last.IsZero() || last.After(now) {
+			return now.Add(r.Interval)
+		}
+		last = last.UTC()
+		periods := now.Sub(last)/r.Interval + 1
+		return last.Add(periods * r.Interval)
+	}
+	return time.Time{}
+}
+
+// monthDay returns the given day of a month at midnight UTC,
+// or the last day of the month if it is shorter
+func monthDay(year int, month time.Month, day int) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// NextReset returns when the quota of the key resets after now,
+// zero if its rule has no schedule
+func (k *APIKey) NextReset(now time.Time) time.Time {
+	if k.RefreshesAt.After(now) {
+		return k.RefreshesAt
+	}
+	rule, err := ParseResetRule(k.ResetRule)
+	if err != nil {
+		rule = DefaultResetRule
+	}
+	return rule.Next(k.RefreshesAt, now)
+}
+
+// resetQuota resets the quota of a key whose refresh time has passed
+// and schedules the next reset from its rule
+func resetQuota(q querier, key *APIKey, now time.Time) error {
+	next := key.NextReset(now)
+	_, err := q.Exec(`
+		UPDATE api_keys SET quota_used = 0, refreshes_at = ?, last_reset_at = ?
+		WHERE id = ? AND refreshes_at <= ?
+	`, nullTime(next), now.UTC(), key.ID, now.UTC())
+	if err != nil {
+		return err
+	}
+	key.QuotaUsed = 0
+	key.RefreshesAt = next
+	key.LastResetAt = now.UTC()
+	return nil
+}
+
+// RecordAPIKeyReset records a quota reset noticed from the API
+func (d *DB) RecordAPIKeyReset(id int, now time.Time) error {
+	_, err := d.db.Exec("UPDATE api_keys SET last_reset_at = ? WHERE id = ?", now.UTC(), id)
+	return err
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseResetRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ResetRule
+		wantErr bool
+	}{
+		{in: "", want: DefaultResetRule},
+		{in: "monthly", want: DefaultResetRule},
+		{in: "monthly:15", want: ResetRule{Kind: ResetMonthly, Day: 15}},
+		{in: " MONTHLY:31 ", want: ResetRule{Kind: ResetMonthly, Day: 31}},
+		{in: "monthly:0", wantErr: true},
+		{in: "monthly:32", wantErr: true},
+		{in: "monthly:first", wantErr: true},
+		{in: "interval:30d", want: ResetRule{Kind: ResetInterval, Interval: 30 * 24 * time.Hour}},
+		{in: "interval:12h", want: ResetRule{Kind: ResetInterval, Interval: 12 * time.Hour}},
+		{in: "interval:90m", want: ResetRule{Kind: ResetInterval, Interval: 90 * time.Minute}},
+		{in: "interval:", wantErr: true},
+		{in: "interval:0d", wantErr: true},
+		{in: "interval:-1h", wantErr: true},
+		{in: "interval:1.5d", wantErr: true},
+		{in: "interval:36500d", want: ResetRule{Kind: ResetInterval, Interval: 36500 * 24 * time.Hour}},
+		{in: "interval:36501d", wantErr: true},
+		{in: "interval:999999999d", wantErr: true},
+		{in: "interval:9999999999999d", wantErr: true},
+		{in: "interval:-9999999999999d", wantErr: true},
+		{in: "interval:900000h", wantErr: true},
+		{in: "interval:99999999999h", wantErr: true},
+		{in: "never", want: ResetRule{Kind: ResetNever}},
+		{in: "auto", want: ResetRule{Kind: ResetAuto}},
+		{in: "never:1", wantErr: true},
+		{in: "weekly", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseResetRule(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseResetRule(%q) = %+v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseResetRule(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestResetRuleStringRoundTrip(t *testing.T) {
+	for _, s := range []string{"monthly:1", "monthly:31", "interval:30d", "interval:12h", "interval:90m", "interval:1m30s", "never", "auto"} {
+		rule, err := ParseResetRule(s)
+		if err != nil {
+			t.Fatalf("ParseResetRule(%q): %v", s, err)
+		}
+		if got := rule.String(); got != s {
+			t.Errorf("ParseResetRule(%q).String() = %q", s, got)
+		}
+	}
+}
+
+func TestResetRuleNext(t *testing.T) {
+	date := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	}
+	monthly := func(day int) ResetRule { return ResetRule{Kind: ResetMonthly, Day: day} }
+	weekly := ResetRule{Kind: ResetInterval, Interval: 7 * 24 * time.Hour}
+
+	tests := []struct {
+		name string
+		rule ResetRule
+		last time.Time
+		now  time.Time
+		want time.Time
+	}{
+		{"later this month", monthly(15), time.Time{}, date(2026, 3, 10, 12), date(2026, 3, 15, 0)},
+		{"next month", monthly(15), time.Time{}, date(2026, 3, 20, 12), date(2026, 4, 15, 0)},
+		{"on the reset day", monthly(15), time.Time{}, date(2026, 3, 15, 0), date(2026, 4, 15, 0)},
+		{"day 31 in February", monthly(31), time.Time{}, date(2026, 1, 31, 12), date(2026, 2, 28, 0)},
+		{"day 31 in a leap February", monthly(31), time.Time{}, date(2028, 2, 10, 0), date(2028, 2, 29, 0)},
+		{"day 31 after February", monthly(31), time.Time{}, date(2026, 2, 28, 12), date(2026, 3, 31, 0)},
+		{"day 31 in April", monthly(31), time.Time{}, date(2026, 4, 1, 0), date(2026, 4, 30, 0)},
+		{"December rollover", monthly(1), time.Time{}, date(2026, 12, 5, 0), date(2027, 1, 1, 0)},
+		{"non-UTC now", monthly(1), time.Time{}, time.Date(2026, 12, 31, 23, 0, 0, 0, time.FixedZone("", -3*3600)), date(2027, 2, 1, 0)},
+		{"interval without last", weekly, time.Time{}, date(2026, 3, 1, 0), date(2026, 3, 8, 0)},
+		{"interval with future last", weekly, date(2026, 4, 1, 0), date(2026, 3, 1, 0), date(2026, 3, 8, 0)},
+		{"interval within the first period", weekly, date(2026, 3, 1, 0), date(2026, 3, 3, 0), date(2026, 3, 8, 0)},
+		{"interval catch-up", weekly, date(2026, 1, 1, 0), date(2026, 1, 20, 0), date(2026, 1, 22, 0)},
+		{"interval on a boundary", weekly, date(2026, 1, 1, 0), date(2026, 1, 15, 0), date(2026, 1, 22, 0)},
+		{"never", ResetRule{Kind: ResetNever}, time.Time{}, date(2026, 3, 1, 0), time.Time{}},
+		{"auto", ResetRule{Kind: ResetAuto}, time.Time{}, date(2026, 3, 1, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Next(tt.last, tt.now); !got.Equal(tt.want) {
+				t.Errorf("Next(%v, %v) = %v, want %v", tt.last, tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonthDay(t *testing.T) {
+	tests := []struct {
+		year  int
+		month time.Month
+		day   int
+		want  time.Time
+	}{
+		{2026, time.March, 15, time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{2026, time.February, 30, time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{2026, time.June, 31, time.Date(2026, 6, 30, 0, 0, 0, 0, time.UTC)},
+		{2026, 13, 31, time.Date(2027, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{2026, 14, 31, time.Date(2027, 2, 28, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := monthDay(tt.year, tt.month, tt.day); !got.Equal(tt.want) {
+			t.Errorf("monthDay(%d, %d, %d) = %v, want %v", tt.year, tt.month, tt.day, got, tt.want)
+		}
+	}
+}
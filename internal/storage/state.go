@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Key states
+const (
+	// StateActive keys are used for requests
+	StateActive = "active"
+	// StateInvalid keys were rejected by the API
+	StateInvalid = "invalid"
+	// StateExhausted keys are out of credits until state_until
+	StateExhausted = "exhausted"
+	// StateRateLimited keys are rate-limited until state_until
+	StateRateLimited = "rate_limited"
+	// StateDisabled keys were disabled by an admin
+	StateDisabled = "disabled"
+)
+
+// ValidState reports whether state is a known key state
+func ValidState(state string) bool {
+	switch state {
+	case StateActive, StateInvalid, StateExhausted, StateRateLimited, StateDisabled:
+		return true
+	}
+	return false
+}
+
+// isErrorState reports whether entering state counts as a key error
+func isErrorState(state string) bool {
+	return state == StateInvalid || state == StateExhausted || state == StateRateLimited
+}
+
+// KeyEvent represents a state transition of a key
+type KeyEvent struct {
+	ID        int       `json:"id"`
+	KeyID     int       `json:"key_id"`
+	FromState string    `json:"from_state"`
+	ToState   string    `json:"to_state"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SetAPIKeyState moves a key to a new state and records the transition
+// until is when a temporary state (exhausted, rate-limited) ends, zero if unknown
+func (d *DB) SetAPIKeyState(id int, state, reason string, until time.Time) error {
+	if !ValidState(state) {
+		return fmt.Errorf("invalid key state %q", state)
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setState(tx, id, state, reason, until); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setState moves a key to a new state within a transaction
+func setState(tx *sql.Tx, id int, state, reason string, until time.Time) error {
+	var fromState, fromReason string
+	err := tx.QueryRow("SELECT state, state_reason FROM api_keys WHERE id = ?", id).Scan(&fromState, &fromReason)
+	if err != nil {
+		return err
+	}
+
+	errorIncrement := 0
+	if isErrorState(state) {
+		errorIncrement = 1
+	}
+	_, err = tx.Exec(`
+		UPDATE api_keys
+		SET state = ?, state_reason = ?, state_until = ?, is_active = ?,
+		    error_count = error_count + ?, last_checked = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, state, reason, nullTime(until), state == StateActive, errorIncrement, id)
+	if err != nil {
+		return err
+	}
+
+	// Entering another state restarts the probe backoff
+	if fromState != state {
+		_, err = tx.Exec("UPDATE api_keys SET probe_attempts = 0, next_probe_at = NULL WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only record actual transitions
+	if fromState == state && fromReason == reason {
+		return nil
+	}
+	_, err = tx.Exec(
+		"INSERT INTO key_events (key_id, from_state, to_state, reason, created_at) VALUES (?, ?, ?, ?, ?)",
+		id, fromState, state, reason, time.Now().UTC(),
+	)
+	return err
+}
+
+// GetAPIKeyEvents gets the state transitions of a key, most recent first
+func (d *DB) GetAPIKeyEvents(id int) ([]*KeyEvent, error) {
+	rows, err := d.db.Query(`
+		SELECT id, key_id, from_state, to_state, reason, created_at
+		FROM key_events
+		WHERE key_id = ?
+		ORDER BY id DESC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*KeyEvent{}
+	for rows.Next() {
+		var event KeyEvent
+		err := rows.Scan(
+			&event.ID, &event.KeyID, &event.FromState, &event.ToState, &event.Reason, &event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// GetAPIKeysToProbe gets the unexpired, unarchived invalid and exhausted keys due for a probe
+// Disabled keys are left to admins, rate-limited ones recover on their own
+func (d *DB) GetAPIKeysToProbe(now time.Time) ([]*APIKey, error) {
+	return d.queryAPIKeys(
+		`state IN ('invalid', 'exhausted') AND (next_probe_at IS NULL OR next_probe_at <= ?)
+		 AND (expires_at IS NULL OR expires_at > ?) AND archived_at IS NULL`,
+		now.UTC(), now.UTC(),
+	)
+}
+
+// ScheduleAPIKeyProbe records a failed probe and when to probe the key next
+func (d *DB) ScheduleAPIKeyProbe(id int, attempts int, next time.Time) error {
+	_, err := d.db.Exec(
+		"UPDATE api_keys SET probe_attempts = ?, next_probe_at = ? WHERE id = ?",
+		attempts, next.UTC(), id,
+	)
+	return err
+}
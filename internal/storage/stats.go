@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// Groupings of the usage statistics
+const (
+	StatsByKey      = "key"
+	StatsByDay      = "day"
+	StatsByEndpoint = "endpoint"
+	StatsByClient   = "client"
+	StatsByQuery    = "query"
+)
+
+// statsGroups maps each grouping to its SQL expression and order, and
+// whether it counts the attempts of keys that failed over, which are
+// requests of the key but not of the client
+var statsGroups = map[string]struct {
+	expr      string
+	order     string
+	failovers bool
+}{
+	StatsByKey:      {"COALESCE(CAST(r.key_id AS TEXT), '')", "query_credits DESC, requests DESC", true},
+	StatsByDay:      {"substr(r.timestamp, 1, 10)", "grp", false},
+	StatsByEndpoint: {"r.method || ' ' || r.path", "query_credits DESC, requests DESC", false},
+	StatsByClient:   {"r.client", "query_credits DESC, requests DESC", false},
+	StatsByQuery:    {"r.method || ' ' || r.path || CASE WHEN r.query = '' THEN '' ELSE '?' || r.query END", "requests DESC, query_credits DESC", false},
+}
+
+// UsageStat sums up the logged requests of a group
+type UsageStat struct {
+	Group        string  `json:"group"`
+	Label        string  `json:"label,omitempty"` // Label of the key when grouped by key
+	Requests     int     `json:"requests"`
+	Cached       int     `json:"cached"` // Requests answered from the cache
+	QueryCredits int     `json:"query_credits"`
+	ScanCredits  int     `json:"scan_credits"`
+	Errors       int     `json:"errors"` // Requests answered with a status of 400 or more
+	ErrorRate    float64 `json:"error_rate"`
+}
+
+// GetUsageStats sums up the requests logged between from and to (zero if
+// unbounded) by key, day, endpoint, client or query, at most limit groups
+// if positive
+func (d *DB) GetUsageStats(groupBy string, from, to time.Time, limit int) ([]*UsageStat, error) {
+	group, ok := statsGroups[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown statistics grouping %q", groupBy)
+	}
+
+	where, args := LogFilter{From: from, To: to}.where()
+	if !group.failovers {
+		where += " AND NOT r.failed_over"
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := d.db.Query(`
+		SELECT `+group.expr+` AS grp, COALESCE(MAX(k.label), ''),
+		       COUNT(*) AS requests, SUM(r.cached), SUM(r.query_credits) AS query_credits,
+		       SUM(r.scan_credits), SUM(CASE WHEN r.status_code >= 400 THEN 1 ELSE 0 END)
+		FROM request_log r
+		LEFT JOIN api_keys k ON k.id = r.key_id
+		WHERE `+where+`
+		GROUP BY grp
+		ORDER BY `+group.order+`
+		LIMIT ?
+	`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []*UsageStat{}
+	for rows.Next() {
+		var stat UsageStat
+		err := rows.Scan(
+			&stat.Group, &stat.Label,
+			&stat.Requests, &stat.Cached, &stat.QueryCredits, &stat.ScanCredits,
+			&stat.Errors,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if groupBy != StatsByKey {
+			stat.Label = ""
+		}
+		if stat.Requests > 0 {
+			stat.ErrorRate = float64(stat.Errors) / float64(stat.Requests)
+		}
+		stats = append(stats, &stat)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// GetQueryCreditsSpent sums up the query credits each key spent since a time
+func (d *DB) GetQueryCreditsSpent(since time.Time) (map[int]int, error) {
+	rows, err := d.db.Query(`
+		SELECT key_id, SUM(query_credits)
+		FROM request_log
+		WHERE key_id IS NOT NULL AND timestamp >= ?
+		GROUP BY key_id
+	`, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	spent := make(map[int]int)
+	for rows.Next() {
+		var keyID, credits int
+		if err := rows.Scan(&keyID, &credits); err != nil {
+			return nil, err
+		}
+		spent[keyID] = credits
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return spent, nil
+}
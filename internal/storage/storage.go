@@ -2,45 +2,197 @@ package storage
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+
+	"shodone/internal/client"
 )
 
+// ErrDuplicateKey is returned when adding a key that is already stored
+var ErrDuplicateKey = errors.New("API key already exists")
+
 // DB represents the database layer
 type DB struct {
-	db *sql.DB
+	db     *sql.DB
+	cipher *Cipher
 }
 
 // APIKey represents an API key with its status
 type APIKey struct {
-	ID          int       `json:"id"`
-	Key         string    `json:"key"`
-	QuotaLimit  int       `json:"quota_limit"`
-	QuotaUsed   int       `json:"quota_used"`
-	IsActive    bool      `json:"is_active"`
-	LastUsed    time.Time `json:"last_used"`
-	LastChecked time.Time `json:"last_checked"`
-	ErrorCount  int       `json:"error_count"`
-	CreatedAt   time.Time `json:"created_at"`
-	RefreshesAt time.Time `json:"refreshes_at"` // When quota refreshes
-}
-
-// RequestLog represents a log entry for an API request
-type RequestLog struct {
-	ID         int       `json:"id"`
-	Path       string    `json:"path"`
-	Method     string    `json:"method"`
-	StatusCode int       `json:"status_code"`
-	KeyID      int       `json:"key_id"`
-	Timestamp  time.Time `json:"timestamp"`
+	ID            int       `json:"id"`
+	Key           string    `json:"key"`
+	QuotaLimit    int       `json:"quota_limit"`
+	QuotaUsed     int       `json:"quota_used"`
+	IsActive      bool      `json:"is_active"` // Whether State is active
+	State         string    `json:"state"`
+	StateReason   string    `json:"state_reason"`
+	StateUntil    time.Time `json:"state_until"` // When a temporary state ends
+	ProbeAttempts int       `json:"probe_attempts"`
+	NextProbeAt   time.Time `json:"next_probe_at"` // When an unusable key is checked again
+	LastUsed      time.Time `json:"last_used"`
+	LastChecked   time.Time `json:"last_checked"`
+	ErrorCount    int       `json:"error_count"`
+	CreatedAt     time.Time `json:"created_at"`
+	RefreshesAt   time.Time `json:"refreshes_at"` // When quota refreshes
+	ResetRule     string    `json:"reset_rule"`   // How quota refreshes, see ResetRule
+	LastResetAt   time.Time `json:"last_reset_at"`
+	Label         string    `json:"label"`
+	Owner         string    `json:"owner"`
+	Notes         string    `json:"notes"`
+	ExpiresAt     time.Time `json:"expires_at"`  // When a borrowed key stops working
+	Tags          []string  `json:"tags"`        // Pools the key belongs to
+	ArchivedAt    time.Time `json:"archived_at"` // When the key was retired, zero if in use
+
+	// Account information reported by /api-info
+	Plan              string `json:"plan"`
+	ScanCredits       int    `json:"scan_credits"`
+	MonitoredIPs      int    `json:"monitored_ips"`
+	QueryCreditsLimit int    `json:"query_credits_limit"`
+	ScanCreditsLimit  int    `json:"scan_credits_limit"`
+	MonitoredIPsLimit int    `json:"monitored_ips_limit"`
+}
+
+// NewAPIKey holds the fields of a key to add
+// RefreshesAt defaults to the next reset of ResetRule, itself defaulting
+// to DefaultResetRule
+type NewAPIKey struct {
+	Key         string
+	QuotaLimit  int
+	RefreshesAt time.Time
+	ResetRule   string
+	Label       string
+	Owner       string
+	Notes       string
+	ExpiresAt   time.Time
+	Tags        []string
+}
+
+// KeyUpdate holds the fields of a key to update, nil fields are left unchanged
+type KeyUpdate struct {
+	Key         *string // Replaces the key secret, keeping the ID and usage history
+	QuotaLimit  *int
+	QuotaUsed   *int
+	RefreshesAt *time.Time // The zero time removes the refresh time
+	ResetRule   *ResetRule // Also schedules the next reset unless RefreshesAt is set
+	Label       *string
+	Owner       *string
+	Notes       *string
+	ExpiresAt   *time.Time // The zero time removes the expiry
+	Tags        []string
+}
+
+// KeyAccount holds the account information of a key reported by /api-info
+type KeyAccount struct {
+	Plan              string
+	ScanCredits       int
+	MonitoredIPs      int
+	QueryCreditsLimit int
+	ScanCreditsLimit  int
+	MonitoredIPsLimit int
+}
+
+// AccountFromInfo converts the /api-info response to the stored account information
+func AccountFromInfo(info *client.KeyInfo) KeyAccount {
+	return KeyAccount{
+		Plan:              info.Plan,
+		ScanCredits:       info.ScanCredits,
+		MonitoredIPs:      info.MonitoredIPs,
+		QueryCreditsLimit: info.UsageLimits.QueryCredits,
+		ScanCreditsLimit:  info.UsageLimits.ScanCredits,
+		MonitoredIPsLimit: info.UsageLimits.MonitoredIPs,
+	}
+}
+
+// KeyCriteria narrows down the keys ReserveAPIKey may return
+type KeyCriteria struct {
+	// ExcludeIDs lists keys that must not be returned,
+	// e.g. keys already rejected by the upstream for this request
+	ExcludeIDs []int
+	// QueryCredits is the number of query credits the key must have left
+	QueryCredits int
+	// ScanCredits is the number of scan credits the key must have left
+	// Keys whose scan credits were never checked are not excluded
+	ScanCredits int
+	// Pool restricts the keys to those tagged with it when not empty
+	Pool string
+	// Strategy chooses among the matching keys, balanced if nil
+	Strategy Strategy
+	// Plans restricts the keys to these plans when not nil
+	// Keys whose plan was never checked are not excluded
+	Plans []string
+}
+
+// where returns the extra SQL conditions and arguments of the criteria
+func (k KeyCriteria) where() (string, []any) {
+	var conds []string
+	var args []any
+	if k.QueryCredits > 0 {
+		conds = append(conds, "(quota_limit = 0 OR quota_used + ? <= quota_limit)")
+		args = append(args, k.QueryCredits)
+	}
+	if k.ScanCredits > 0 {
+		conds = append(conds, "(scan_credits IS NULL OR scan_credits >= ?)")
+		args = append(args, k.ScanCredits)
+	}
+	if k.Pool != "" {
+		// instr matches the tag exactly, unlike LIKE whose % and _ are wildcards
+		conds = append(conds, "instr(',' || tags || ',', ?) > 0")
+		args = append(args, ","+NormalizeTag(k.Pool)+",")
+	}
+	if k.Plans != nil {
+		if len(k.Plans) == 0 {
+			conds = append(conds, "plan = ''")
+		} else {
+			conds = append(conds, "(plan = '' OR plan IN ("+placeholders(len(k.Plans))+"))")
+			for _, plan := range k.Plans {
+				args = append(args, plan)
+			}
+		}
+	}
+	if len(k.ExcludeIDs) > 0 {
+		conds = append(conds, "id NOT IN ("+placeholders(len(k.ExcludeIDs))+")")
+		for _, id := range k.ExcludeIDs {
+			args = append(args, id)
+		}
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(conds, " AND "), args
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// placeholders returns n comma separated SQL placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
 }
 
 // New creates a new database connection
-func New(dbPath string) (*DB, error) {
+// If masterKey is not nil, key material is encrypted at rest with it,
+// and keys still stored in plaintext are encrypted on open
+func New(dbPath string, masterKey []byte) (*DB, error) {
 	// Open database connection
-	db, err := sql.Open("sqlite3", dbPath)
+	// Transactions take the write lock when they begin, so that key
+	// reservations are atomic even across processes sharing the file,
+	// and concurrent writers wait for the lock instead of failing
+	// Deleted content is zeroed, so overwritten key material does not
+	// linger in free pages
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite3", dbPath+separator+"_txlock=immediate&_busy_timeout=5000&_journal_mode=WAL&_secure_delete=on")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -57,7 +209,21 @@ func New(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
-	return &DB{db: db}, nil
+	d := &DB{db: db}
+	if masterKey != nil {
+		if d.cipher, err = NewCipher(masterKey); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to initialize cipher: %w", err)
+		}
+	}
+
+	// Hash and encrypt existing keys
+	if err := d.migrateKeys(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate API keys: %w", err)
+	}
+
+	return d, nil
 }
 
 // Close closes the database connection
@@ -86,6 +252,43 @@ func initSchema(db *sql.DB) error {
 		return err
 	}
 
+	// Add columns introduced after the first release
+	err = addMissingColumns(db, "api_keys", []column{
+		{"plan", "TEXT DEFAULT ''"},
+		{"scan_credits", "INTEGER"},
+		{"monitored_ips", "INTEGER DEFAULT 0"},
+		{"query_credits_limit", "INTEGER DEFAULT 0"},
+		{"scan_credits_limit", "INTEGER DEFAULT 0"},
+		{"monitored_ips_limit", "INTEGER DEFAULT 0"},
+		{"label", "TEXT DEFAULT ''"},
+		{"key_hash", "TEXT"},
+		{"tags", "TEXT DEFAULT ''"},
+		{"state", "TEXT NOT NULL DEFAULT 'active'"},
+		{"state_reason", "TEXT NOT NULL DEFAULT ''"},
+		{"state_until", "TIMESTAMP"},
+		{"probe_attempts", "INTEGER NOT NULL DEFAULT 0"},
+		{"next_probe_at", "TIMESTAMP"},
+		{"reset_rule", "TEXT NOT NULL DEFAULT 'monthly:1'"},
+		{"last_reset_at", "TIMESTAMP"},
+		{"owner", "TEXT NOT NULL DEFAULT ''"},
+		{"notes", "TEXT NOT NULL DEFAULT ''"},
+		{"expires_at", "TIMESTAMP"},
+		{"archived_at", "TIMESTAMP"},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Keys deactivated before states existed were rejected by the API,
+	// so they become invalid and get probed for reactivation
+	_, err = db.Exec(`
+		UPDATE api_keys SET state = 'invalid', state_reason = 'rejected by the API before key states'
+		WHERE is_active = FALSE AND state = 'active'
+	`)
+	if err != nil {
+		return err
+	}
+
 	// Create requests log table
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS request_log (
@@ -98,44 +301,133 @@ func initSchema(db *sql.DB) error {
 			FOREIGN KEY (key_id) REFERENCES api_keys (id)
 		);
 	`)
+	if err != nil {
+		return err
+	}
+	err = addMissingColumns(db, "request_log", []column{
+		{"query", "TEXT NOT NULL DEFAULT ''"},
+		{"query_credits", "INTEGER NOT NULL DEFAULT 0"},
+		{"scan_credits", "INTEGER NOT NULL DEFAULT 0"},
+		{"latency_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"bytes", "INTEGER NOT NULL DEFAULT 0"},
+		{"client", "TEXT NOT NULL DEFAULT ''"},
+		{"cached", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"failed_over", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_request_log_timestamp ON request_log (timestamp);
+		CREATE INDEX IF NOT EXISTS idx_request_log_key_id ON request_log (key_id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create key events table
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS key_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			key_id INTEGER NOT NULL,
+			from_state TEXT NOT NULL,
+			to_state TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (key_id) REFERENCES api_keys (id)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Create response cache table
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS response_cache (
+			key TEXT PRIMARY KEY,
+			status_code INTEGER NOT NULL,
+			header BLOB,
+			body BLOB,
+			expires_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_response_cache_expires_at ON response_cache (expires_at);
+	`)
 	return err
 }
 
-// AddAPIKey adds a new API key to the database
-func (d *DB) AddAPIKey(key string, quotaLimit int, refreshesAt time.Time) (int, error) {
-	result, err := d.db.Exec(
-		"INSERT INTO api_keys (key, quota_limit, quota_used, is_active, refreshes_at) VALUES (?, ?, 0, TRUE, ?)",
-		key, quotaLimit, refreshesAt,
-	)
+// column describes a table column added by a schema migration
+type column struct {
+	name       string
+	definition string
+}
+
+// addMissingColumns adds the columns that do not exist yet to a table
+func addMissingColumns(db *sql.DB, table string, columns []column) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		return 0, err
+	for _, c := range columns {
+		if existing[c.name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, c.name, c.definition)); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", table, c.name, err)
+		}
 	}
+	return nil
+}
 
-	return int(id), nil
+// apiKeyColumns lists the api_keys columns read by scanAPIKey
+const apiKeyColumns = `id, key, quota_limit, quota_used, is_active,
+		       last_used, last_checked, error_count,
+		       created_at, refreshes_at,
+		       plan, scan_credits, monitored_ips,
+		       query_credits_limit, scan_credits_limit, monitored_ips_limit,
+		       label, tags,
+		       state, state_reason, state_until,
+		       probe_attempts, next_probe_at,
+		       reset_rule, last_reset_at,
+		       owner, notes, expires_at, archived_at`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
 }
 
-// GetAPIKey gets an API key by ID
-func (d *DB) GetAPIKey(id int) (*APIKey, error) {
+// scanAPIKey scans a row selected with apiKeyColumns and decrypts the key
+func (d *DB) scanAPIKey(row rowScanner) (*APIKey, error) {
 	var key APIKey
-	var lastUsed, lastChecked, refreshesAt sql.NullTime
+	var lastUsed, lastChecked, refreshesAt, stateUntil, nextProbeAt, lastResetAt, expiresAt, archivedAt sql.NullTime
+	var scanCredits sql.NullInt64
+	var tags string
 
-	err := d.db.QueryRow(`
-		SELECT id, key, quota_limit, quota_used, is_active, 
-		       last_used, last_checked, error_count,
-		       created_at, refreshes_at
-		FROM api_keys
-		WHERE id = ?
-	`, id).Scan(
+	err := row.Scan(
 		&key.ID, &key.Key, &key.QuotaLimit, &key.QuotaUsed, &key.IsActive,
 		&lastUsed, &lastChecked, &key.ErrorCount,
 		&key.CreatedAt, &refreshesAt,
+		&key.Plan, &scanCredits, &key.MonitoredIPs,
+		&key.QueryCreditsLimit, &key.ScanCreditsLimit, &key.MonitoredIPsLimit,
+		&key.Label, &tags,
+		&key.State, &key.StateReason, &stateUntil,
+		&key.ProbeAttempts, &nextProbeAt,
+		&key.ResetRule, &lastResetAt,
+		&key.Owner, &key.Notes, &expiresAt, &archivedAt,
 	)
-
 	if err != nil {
 		return nil, err
 	}
@@ -152,18 +444,110 @@ func (d *DB) GetAPIKey(id int) (*APIKey, error) {
 		key.RefreshesAt = refreshesAt.Time
 	}
 
+	if scanCredits.Valid {
+		key.ScanCredits = int(scanCredits.Int64)
+	}
+
+	if stateUntil.Valid {
+		key.StateUntil = stateUntil.Time
+	}
+
+	if nextProbeAt.Valid {
+		key.NextProbeAt = nextProbeAt.Time
+	}
+
+	if lastResetAt.Valid {
+		key.LastResetAt = lastResetAt.Time
+	}
+
+	if expiresAt.Valid {
+		key.ExpiresAt = expiresAt.Time
+	}
+
+	if archivedAt.Valid {
+		key.ArchivedAt = archivedAt.Time
+	}
+
+	key.Tags = splitTags(tags)
+
+	if key.Key, err = d.openKey(key.Key); err != nil {
+		return nil, fmt.Errorf("key %d: %w", key.ID, err)
+	}
+
 	return &key, nil
 }
 
-// GetAllAPIKeys gets all API keys
+// AddAPIKey adds a new API key to the database
+// It returns ErrDuplicateKey if the key is already stored
+func (d *DB) AddAPIKey(key NewAPIKey) (int, error) {
+	rule, err := ParseResetRule(key.ResetRule)
+	if err != nil {
+		return 0, err
+	}
+	if key.RefreshesAt.IsZero() {
+		key.RefreshesAt = rule.Next(time.Time{}, time.Now())
+	}
+
+	sealed, err := d.sealKey(key.Key)
+	if err != nil {
+		return 0, err
+	}
+	result, err := d.db.Exec(
+		`INSERT INTO api_keys (key, key_hash, quota_limit, quota_used, is_active, refreshes_at, reset_rule, label, owner, notes, expires_at, tags)
+		VALUES (?, ?, ?, 0, TRUE, ?, ?, ?, ?, ?, ?, ?)`,
+		sealed, hashKey(key.Key), key.QuotaLimit, nullTime(key.RefreshesAt), rule.String(),
+		key.Label, key.Owner, key.Notes, nullTime(key.ExpiresAt), joinTags(key.Tags),
+	)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return 0, ErrDuplicateKey
+		}
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetAPIKey gets an API key by ID
+func (d *DB) GetAPIKey(id int) (*APIKey, error) {
+	return d.scanAPIKey(d.db.QueryRow(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys
+		WHERE id = ?
+	`, id))
+}
+
+// HasAPIKey reports whether a key is stored, archived or not
+func (d *DB) HasAPIKey(key string) (bool, error) {
+	var exists bool
+	err := d.db.QueryRow("SELECT EXISTS (SELECT 1 FROM api_keys WHERE key_hash = ?)", hashKey(key)).Scan(&exists)
+	return exists, err
+}
+
+// GetAllAPIKeys gets all API keys that are not archived
 func (d *DB) GetAllAPIKeys() ([]*APIKey, error) {
+	return d.queryAPIKeys("archived_at IS NULL")
+}
+
+// GetArchivedAPIKeys gets the archived API keys
+func (d *DB) GetArchivedAPIKeys() ([]*APIKey, error) {
+	return d.queryAPIKeys("archived_at IS NOT NULL")
+}
+
+// queryAPIKeys gets the keys matching a WHERE condition, ordered by ID
+func (d *DB) queryAPIKeys(where string, args ...any) ([]*APIKey, error) {
 	rows, err := d.db.Query(`
-		SELECT id, key, quota_limit, quota_used, is_active, 
-		       last_used, last_checked, error_count,
-		       created_at, refreshes_at
+		SELECT `+apiKeyColumns+`
 		FROM api_keys
+		WHERE `+where+`
 		ORDER BY id
-	`)
+	`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -171,140 +555,334 @@ func (d *DB) GetAllAPIKeys() ([]*APIKey, error) {
 
 	var keys []*APIKey
 	for rows.Next() {
-		var key APIKey
-		var lastUsed, lastChecked, refreshesAt sql.NullTime
-
-		err := rows.Scan(
-			&key.ID, &key.Key, &key.QuotaLimit, &key.QuotaUsed, &key.IsActive,
-			&lastUsed, &lastChecked, &key.ErrorCount,
-			&key.CreatedAt, &refreshesAt,
-		)
+		key, err := d.scanAPIKey(rows)
 		if err != nil {
 			return nil, err
 		}
+		keys = append(keys, key)
+	}
 
-		if lastUsed.Valid {
-			key.LastUsed = lastUsed.Time
-		}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		if lastChecked.Valid {
-			key.LastChecked = lastChecked.Time
-		}
+	return keys, nil
+}
 
-		if refreshesAt.Valid {
-			key.RefreshesAt = refreshesAt.Time
-		}
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	Exec(query string, args ...any) (sql.Result, error)
+}
 
-		keys = append(keys, &key)
+// ReserveAPIKey gets an API key with available quota matching criteria,
+// chosen among the candidates by the criteria strategy, and charges it
+// the given credits in the same transaction, so that concurrent requests,
+// even from other processes, cannot pick a key beyond its quota
+func (d *DB) ReserveAPIKey(criteria KeyCriteria, queryCredits, scanCredits int) (*APIKey, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	if err := rows.Err(); err != nil {
+	key, err := d.selectAPIKey(tx, criteria)
+	if err != nil {
 		return nil, err
 	}
 
-	return keys, nil
-}
+	now := time.Now().UTC()
+	_, err = tx.Exec(`
+		UPDATE api_keys
+		SET quota_used = quota_used + ?, scan_credits = scan_credits - ?, last_used = ?
+		WHERE id = ?
+	`, queryCredits, scanCredits, now, key.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 
-// GetAvailableAPIKey gets an API key with available quota
-func (d *DB) GetAvailableAPIKey() (*APIKey, error) {
-	var key APIKey
-	var lastUsed, lastChecked, refreshesAt sql.NullTime
+	key.QuotaUsed += queryCredits
+	key.ScanCredits -= scanCredits
+	key.LastUsed = now
+	return key, nil
+}
 
-	// Try to get a key with available quota
-	err := d.db.QueryRow(`
-		SELECT id, key, quota_limit, quota_used, is_active, 
-		       last_used, last_checked, error_count,
-		       created_at, refreshes_at
-		FROM api_keys
-		WHERE is_active = TRUE AND (quota_limit = 0 OR quota_used < quota_limit)
-		ORDER BY quota_used * 1.0 / CASE WHEN quota_limit = 0 THEN 1 ELSE quota_limit END ASC,
-		         last_used ASC
-		LIMIT 1
-	`).Scan(
-		&key.ID, &key.Key, &key.QuotaLimit, &key.QuotaUsed, &key.IsActive,
-		&lastUsed, &lastChecked, &key.ErrorCount,
-		&key.CreatedAt, &refreshesAt,
+// RefundAPIKey gives back credits charged by ReserveAPIKey
+func (d *DB) RefundAPIKey(id int, queryCredits, scanCredits int) error {
+	_, err := d.db.Exec(
+		"UPDATE api_keys SET quota_used = quota_used - ?, scan_credits = scan_credits + ? WHERE id = ?",
+		queryCredits, scanCredits, id,
 	)
+	return err
+}
 
+// selectAPIKey chooses an available key matching criteria within tx,
+// resetting its quota if its refresh time has passed
+func (d *DB) selectAPIKey(tx *sql.Tx, criteria KeyCriteria) (*APIKey, error) {
+	strategy := criteria.Strategy
+	if strategy == nil {
+		strategy = balancedStrategy{}
+	}
+
+	// Get the unexpired, unarchived keys with available quota
+	now := time.Now().UTC()
+	cond, args := criteria.where()
+	rows, err := tx.Query(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys
+		WHERE (state = 'active' OR (state IN ('exhausted', 'rate_limited') AND state_until <= ?))
+		  AND (expires_at IS NULL OR expires_at > ?) AND archived_at IS NULL
+		  AND (quota_limit = 0 OR quota_used < quota_limit)`+cond+`
+		ORDER BY id
+	`, append([]any{now, now}, args...)...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	if lastUsed.Valid {
-		key.LastUsed = lastUsed.Time
+	var candidates []*APIKey
+	for rows.Next() {
+		key, err := d.scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, key)
 	}
-
-	if lastChecked.Valid {
-		key.LastChecked = lastChecked.Time
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, sql.ErrNoRows
 	}
 
-	if refreshesAt.Valid {
-		key.RefreshesAt = refreshesAt.Time
+	key := strategy.Choose(candidates)
+
+	// A temporary state that has ended makes the key active again
+	if key.State != StateActive {
+		if err := setState(tx, key.ID, StateActive, key.State+" period ended", time.Time{}); err != nil {
+			return nil, err
+		}
+		key.State, key.StateReason, key.StateUntil, key.IsActive = StateActive, "", time.Time{}, true
 	}
 
 	// Check if quota should be reset
 	currentTime := time.Now()
 	if key.RefreshesAt.Before(currentTime) && !key.RefreshesAt.IsZero() {
-		// Calculate next refresh time (default 1st of every month)
-		// Use UTC to avoid some potential issues
-		nextRefresh := time.Date(
-			currentTime.Year(), currentTime.Month(), 1, 0, 0, 0, 0, time.UTC,
-		).AddDate(0, 1, 0)
-
-		// Reset quota and update refresh time
-		_, err := d.db.Exec(
-			"UPDATE api_keys SET quota_used = 0, refreshes_at = ? WHERE id = ?",
-			nextRefresh, key.ID,
-		)
-		if err != nil {
+		if err := resetQuota(tx, key, currentTime); err != nil {
 			return nil, err
 		}
+	}
 
-		key.QuotaUsed = 0
-		key.RefreshesAt = nextRefresh
+	return key, nil
+}
+
+// ResetExpiredQuotas resets the quota of every key whose refresh time has passed
+// It returns the IDs of the keys that were reset
+func (d *DB) ResetExpiredQuotas(now time.Time) ([]int, error) {
+	keys, err := d.queryAPIKeys("refreshes_at IS NOT NULL AND refreshes_at <= ?", now.UTC())
+	if err != nil {
+		return nil, err
 	}
 
-	return &key, nil
+	var ids []int
+	for _, key := range keys {
+		if err := resetQuota(d.db, key, now); err != nil {
+			return nil, err
+		}
+		ids = append(ids, key.ID)
+	}
+	return ids, nil
 }
 
-// IncrementAPIKeyUsage increments the quota used by an API key
-func (d *DB) IncrementAPIKeyUsage(id int, incrementQuota int) error {
-	_, err := d.db.Exec(
-		"UPDATE api_keys SET quota_used = quota_used + ?, last_used = CURRENT_TIMESTAMP WHERE id = ?",
-		incrementQuota, id,
+// UpdateAPIKeyAccount updates the account information of an API key
+func (d *DB) UpdateAPIKeyAccount(id int, account KeyAccount) error {
+	_, err := d.db.Exec(`
+		UPDATE api_keys
+		SET plan = ?, scan_credits = ?, monitored_ips = ?,
+		    query_credits_limit = ?, scan_credits_limit = ?, monitored_ips_limit = ?,
+		    last_checked = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`,
+		account.Plan, account.ScanCredits, account.MonitoredIPs,
+		account.QueryCreditsLimit, account.ScanCreditsLimit, account.MonitoredIPsLimit,
+		id,
 	)
 	return err
 }
 
 // UpdateAPIKeyUsage updates the quota used by an API key
+// It does not touch last_used, which the selection strategies rely on
 func (d *DB) UpdateAPIKeyUsage(id int, quotaUsed int) error {
 	_, err := d.db.Exec(
-		"UPDATE api_keys SET quota_used = ?, last_used = CURRENT_TIMESTAMP WHERE id = ?",
+		"UPDATE api_keys SET quota_used = ? WHERE id = ?",
 		quotaUsed, id,
 	)
 	return err
 }
 
-// UpdateAPIKeyStatus updates the status of an API key
-func (d *DB) UpdateAPIKeyStatus(id int, isActive bool, errorCount int) error {
-	_, err := d.db.Exec(
-		"UPDATE api_keys SET is_active = ?, error_count = ?, last_checked = CURRENT_TIMESTAMP WHERE id = ?",
-		isActive, errorCount, id,
-	)
-	return err
+// StoreAPIKeyInfo stores the usage and account information reported by
+// /api-info, the usage being what quotaLimit leaves of the remaining credits
+func (d *DB) StoreAPIKeyInfo(id int, quotaLimit int, info *client.KeyInfo) error {
+	quotaUsed := max(quotaLimit-info.QueryCredits, 0)
+	if err := d.UpdateAPIKeyUsage(id, quotaUsed); err != nil {
+		return fmt.Errorf("failed to update API key usage: %v", err)
+	}
+	if err := d.UpdateAPIKeyAccount(id, AccountFromInfo(info)); err != nil {
+		return fmt.Errorf("failed to update API key account: %v", err)
+	}
+	return nil
 }
 
-// LogRequest logs an API request
-func (d *DB) LogRequest(path, method string, statusCode int, keyID int) error {
+// UpdateAPIKey updates the fields set in update in a single statement
+// It returns ErrDuplicateKey if the new key secret is already stored
+func (d *DB) UpdateAPIKey(id int, update KeyUpdate) error {
+	var sets []string
+	var args []any
+	set := func(column string, value any) {
+		sets = append(sets, column+" = ?")
+		args = append(args, value)
+	}
+
+	if update.Key != nil {
+		sealed, err := d.sealKey(*update.Key)
+		if err != nil {
+			return err
+		}
+		set("key", sealed)
+		set("key_hash", hashKey(*update.Key))
+	}
+	if update.QuotaLimit != nil {
+		set("quota_limit", *update.QuotaLimit)
+	}
+	if update.QuotaUsed != nil {
+		set("quota_used", *update.QuotaUsed)
+	}
+	if update.ResetRule != nil {
+		set("reset_rule", update.ResetRule.String())
+		if update.RefreshesAt == nil {
+			set("refreshes_at", nullTime(update.ResetRule.Next(time.Time{}, time.Now())))
+		}
+	}
+	if update.RefreshesAt != nil {
+		set("refreshes_at", nullTime(*update.RefreshesAt))
+	}
+	if update.Label != nil {
+		set("label", *update.Label)
+	}
+	if update.Owner != nil {
+		set("owner", *update.Owner)
+	}
+	if update.Notes != nil {
+		set("notes", *update.Notes)
+	}
+	if update.ExpiresAt != nil {
+		set("expires_at", nullTime(*update.ExpiresAt))
+	}
+	if update.Tags != nil {
+		set("tags", joinTags(update.Tags))
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
 	_, err := d.db.Exec(
-		"INSERT INTO request_log (path, method, status_code, key_id) VALUES (?, ?, ?, ?)",
-		path, method, statusCode, keyID,
+		"UPDATE api_keys SET "+strings.Join(sets, ", ")+" WHERE id = ?",
+		append(args, id)...,
 	)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrDuplicateKey
+	}
 	return err
 }
 
-// DeleteAPIKey deletes an API key
-func (d *DB) DeleteAPIKey(id int) error {
-	_, err := d.db.Exec("DELETE FROM api_keys WHERE id = ?", id)
-	return err
+// GetExpiringAPIKeys gets the unarchived keys expiring before a time, expired ones included
+func (d *DB) GetExpiringAPIKeys(before time.Time) ([]*APIKey, error) {
+	return d.queryAPIKeys("expires_at IS NOT NULL AND expires_at <= ? AND archived_at IS NULL", before.UTC())
+}
+
+// NormalizeTag returns the stored form of a tag: trimmed, lower case,
+// without commas
+func NormalizeTag(tag string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(tag)), ",", "")
+}
+
+// joinTags returns the stored form of a list of tags, deduplicated
+func joinTags(tags []string) string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return strings.Join(normalized, ",")
+}
+
+// splitTags parses the stored form of a list of tags
+func splitTags(tags string) []string {
+	if tags == "" {
+		return []string{}
+	}
+	return strings.Split(tags, ",")
+}
+
+// HasTag reports whether the key is tagged with tag
+func (k *APIKey) HasTag(tag string) bool {
+	tag = NormalizeTag(tag)
+	for _, t := range k.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ArchiveAPIKey retires an API key, keeping its usage history
+// Archived keys are no longer selected nor listed by GetAllAPIKeys
+func (d *DB) ArchiveAPIKey(id int) error {
+	return d.setArchivedAt(id, time.Now().UTC())
+}
+
+// RestoreAPIKey puts an archived API key back in use
+func (d *DB) RestoreAPIKey(id int) error {
+	return d.setArchivedAt(id, nil)
+}
+
+// setArchivedAt sets archived_at of a key, returning sql.ErrNoRows if there is no such key
+func (d *DB) setArchivedAt(id int, archivedAt any) error {
+	result, err := d.db.Exec("UPDATE api_keys SET archived_at = ? WHERE id = ?", archivedAt, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PurgeAPIKey deletes an API key with its request log and state history
+func (d *DB) PurgeAPIKey(id int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM request_log WHERE key_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM key_events WHERE key_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM api_keys WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
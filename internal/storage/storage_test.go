@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReserveAPIKeyConcurrentProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shodone.db")
+
+	// Two handles on the same file stand for two processes
+	first := openTestDB(t, path, nil)
+	second := openTestDB(t, path, nil)
+	limits := map[int]int{}
+	for i, limit := range []int{7, 13} {
+		id, err := first.AddAPIKey(NewAPIKey{Key: testSecrets[i], QuotaLimit: limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		limits[id] = limit
+	}
+
+	const workers = 32
+	const attemptsPerWorker = 5
+	var mu sync.Mutex
+	reserved := map[int]int{}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		db := first
+		if w%2 == 1 {
+			db = second
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range attemptsPerWorker {
+				key, err := db.ReserveAPIKey(KeyCriteria{QueryCredits: 1}, 1, 0)
+				if errors.Is(err, sql.ErrNoRows) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("ReserveAPIKey: %v", err)
+					return
+				}
+				mu.Lock()
+				reserved[key.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for id, limit := range limits {
+		if reserved[id] != limit {
+			t.Errorf("key %d reserved %d times, want its limit %d", id, reserved[id], limit)
+		}
+		key, err := first.GetAPIKey(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.QuotaUsed != limit {
+			t.Errorf("key %d used %d credits, want %d", id, key.QuotaUsed, limit)
+		}
+	}
+}
+
+func TestReserveAPIKeyCharges(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "shodone.db"), nil)
+	id, err := db.AddAPIKey(NewAPIKey{Key: testSecrets[0], QuotaLimit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateAPIKeyAccount(id, KeyAccount{ScanCredits: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := db.ReserveAPIKey(KeyCriteria{QueryCredits: 2, ScanCredits: 3}, 2, 3)
+	if err != nil {
+		t.Fatalf("ReserveAPIKey: %v", err)
+	}
+	if key.QuotaUsed != 2 || key.ScanCredits != 2 || key.LastUsed.IsZero() {
+		t.Errorf("reserved key = used %d, scan %d, last used %v", key.QuotaUsed, key.ScanCredits, key.LastUsed)
+	}
+	stored, _ := db.GetAPIKey(id)
+	if stored.QuotaUsed != 2 || stored.ScanCredits != 2 {
+		t.Errorf("stored key = used %d, scan %d, want 2 and 2", stored.QuotaUsed, stored.ScanCredits)
+	}
+
+	// Not enough scan credits left
+	if _, err := db.ReserveAPIKey(KeyCriteria{ScanCredits: 3}, 0, 3); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ReserveAPIKey beyond the scan credits = %v, want sql.ErrNoRows", err)
+	}
+	// Not enough query credits left
+	if _, err := db.ReserveAPIKey(KeyCriteria{QueryCredits: 9}, 9, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ReserveAPIKey beyond the quota = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := db.RefundAPIKey(id, 2, 3); err != nil {
+		t.Fatalf("RefundAPIKey: %v", err)
+	}
+	stored, _ = db.GetAPIKey(id)
+	if stored.QuotaUsed != 0 || stored.ScanCredits != 5 {
+		t.Errorf("refunded key = used %d, scan %d, want 0 and 5", stored.QuotaUsed, stored.ScanCredits)
+	}
+}
+
+func TestReserveAPIKeyExcludesUnusableKeys(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "shodone.db"), nil)
+	var ids []int
+	for i := range 4 {
+		id, err := db.AddAPIKey(NewAPIKey{Key: testSecrets[i], QuotaLimit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.SetAPIKeyState(ids[0], StateInvalid, "test", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetAPIKeyState(ids[1], StateDisabled, "test", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ArchiveAPIKey(ids[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := db.ReserveAPIKey(KeyCriteria{}, 1, 0)
+	if err != nil || key.ID != ids[3] {
+		t.Fatalf("ReserveAPIKey = %v, %v, want key %d", key, err, ids[3])
+	}
+	if _, err := db.ReserveAPIKey(KeyCriteria{ExcludeIDs: []int{ids[3]}}, 1, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ReserveAPIKey excluding the only usable key = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestReserveAPIKeyPlans(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "shodone.db"), nil)
+	plans := []string{"oss", "corp", ""}
+	ids := map[string]int{}
+	for i, plan := range plans {
+		id, err := db.AddAPIKey(NewAPIKey{Key: testSecrets[i], QuotaLimit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan != "" {
+			if err := db.UpdateAPIKeyAccount(id, KeyAccount{Plan: plan}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids[plan] = id
+	}
+
+	// Keys whose plan was never checked are not excluded
+	allowed := map[int]bool{}
+	for range 10 {
+		key, err := db.ReserveAPIKey(KeyCriteria{Plans: []string{"corp"}}, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed[key.ID] = true
+	}
+	if !allowed[ids["corp"]] || !allowed[ids[""]] || allowed[ids["oss"]] {
+		t.Errorf("reserved keys %v, want the corp key and the unchecked one", allowed)
+	}
+
+	// No supporting plan leaves only the unchecked keys
+	key, err := db.ReserveAPIKey(KeyCriteria{Plans: []string{}}, 1, 0)
+	if err != nil || key.ID != ids[""] {
+		t.Errorf("ReserveAPIKey without supporting plan = %v, %v, want the unchecked key", key, err)
+	}
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+)
+
+// Names of the key selection strategies
+const (
+	StrategyBalanced   = "balanced"
+	StrategyRoundRobin = "round-robin"
+	StrategyWeighted   = "weighted"
+	StrategyLRU        = "least-recently-used"
+	StrategyDrain      = "drain"
+	StrategyRandom     = "random"
+)
+
+// Strategy chooses one key among the candidates available for a request
+// Candidates are never empty and are sorted by ID
+type Strategy interface {
+	Choose(candidates []*APIKey) *APIKey
+}
+
+// StrategyByName returns the strategy with the given name
+func StrategyByName(name string) (Strategy, error) {
+	switch name {
+	case StrategyBalanced, "":
+		return balancedStrategy{}, nil
+	case StrategyRoundRobin:
+		return roundRobinStrategy{}, nil
+	case StrategyWeighted:
+		return weightedStrategy{}, nil
+	case StrategyLRU:
+		return lruStrategy{}, nil
+	case StrategyDrain:
+		return drainStrategy{}, nil
+	case StrategyRandom:
+		return randomStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown key selection strategy %q", name)
+}
+
+// balancedStrategy picks the key with the lowest usage ratio,
+// then the least recently used one
+type balancedStrategy struct{}
+
+func (balancedStrategy) Choose(candidates []*APIKey) *APIKey {
+	sorted := append([]*APIKey(nil), candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ri, rj := usageRatio(sorted[i]), usageRatio(sorted[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return sorted[i].LastUsed.Before(sorted[j].LastUsed)
+	})
+	return sorted[0]
+}
+
+// roundRobinStrategy picks the key following, by ID, the most recently used one
+// It relies on last_used only, so it also rotates across processes
+type roundRobinStrategy struct{}
+
+func (roundRobinStrategy) Choose(candidates []*APIKey) *APIKey {
+	last := candidates[0]
+	for _, key := range candidates {
+		if key.LastUsed.After(last.LastUsed) {
+			last = key
+		}
+	}
+	if last.LastUsed.IsZero() {
+		return candidates[0]
+	}
+	for _, key := range candidates {
+		if key.ID > last.ID {
+			return key
+		}
+	}
+	return candidates[0]
+}
+
+// weightedStrategy picks a random key, weighted by its remaining query credits
+// Keys without quota limit weigh as much as the richest limited key
+type weightedStrategy struct{}
+
+func (weightedStrategy) Choose(candidates []*APIKey) *APIKey {
+	weights := make([]int, len(candidates))
+	maxWeight := 1
+	for i, key := range candidates {
+		if key.QuotaLimit > 0 {
+			weights[i] = max(key.QuotaLimit-key.QuotaUsed, 0)
+			maxWeight = max(maxWeight, weights[i])
+		}
+	}
+	total := 0
+	for i, key := range candidates {
+		if key.QuotaLimit == 0 {
+			weights[i] = maxWeight
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return candidates[rand.IntN(len(candidates))]
+	}
+
+	n := rand.IntN(total)
+	for i, weight := range weights {
+		if n < weight {
+			return candidates[i]
+		}
+		n -= weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+// lruStrategy picks the least recently used key
+type lruStrategy struct{}
+
+func (lruStrategy) Choose(candidates []*APIKey) *APIKey {
+	chosen := candidates[0]
+	for _, key := range candidates[1:] {
+		if key.LastUsed.Before(chosen.LastUsed) {
+			chosen = key
+		}
+	}
+	return chosen
+}
+
+// drainStrategy keeps using the most used key until it runs out of credits
+type drainStrategy struct{}
+
+func (drainStrategy) Choose(candidates []*APIKey) *APIKey {
+	chosen := candidates[0]
+	for _, key := range candidates[1:] {
+		if usageRatio(key) > usageRatio(chosen) {
+			chosen = key
+		}
+	}
+	return chosen
+}
+
+// randomStrategy picks a key uniformly at random
+type randomStrategy struct{}
+
+func (randomStrategy) Choose(candidates []*APIKey) *APIKey {
+	return candidates[rand.IntN(len(candidates))]
+}
+
+// usageRatio returns the share of the quota a key has used
+func usageRatio(key *APIKey) float64 {
+	if key.QuotaLimit == 0 {
+		return float64(key.QuotaUsed)
+	}
+	return float64(key.QuotaUsed) / float64(key.QuotaLimit)
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStrategyByName(t *testing.T) {
+	for _, name := range []string{"", StrategyBalanced, StrategyRoundRobin, StrategyWeighted, StrategyLRU, StrategyDrain, StrategyRandom} {
+		if _, err := StrategyByName(name); err != nil {
+			t.Errorf("StrategyByName(%q): %v", name, err)
+		}
+	}
+	if _, err := StrategyByName("Balanced"); err == nil {
+		t.Error("StrategyByName(\"Balanced\") succeeded, want an error")
+	}
+}
+
+func TestStrategyChoose(t *testing.T) {
+	base := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	key := func(id, limit, used, lastUsedMinutes int) *APIKey {
+		k := &APIKey{ID: id, QuotaLimit: limit, QuotaUsed: used}
+		if lastUsedMinutes >= 0 {
+			k.LastUsed = base.Add(time.Duration(lastUsedMinutes) * time.Minute)
+		}
+		return k
+	}
+
+	tests := []struct {
+		name       string
+		strategy   string
+		candidates []*APIKey
+		want       int
+	}{
+		{"balanced lowest ratio", StrategyBalanced, []*APIKey{key(1, 100, 50, 1), key(2, 1000, 100, 2), key(3, 10, 9, 3)}, 2},
+		{"balanced ties by last use", StrategyBalanced, []*APIKey{key(1, 100, 10, 5), key(2, 100, 10, 1), key(3, 100, 10, -1)}, 3},
+		{"balanced single key", StrategyBalanced, []*APIKey{key(7, 100, 99, 1)}, 7},
+		{"round-robin never used", StrategyRoundRobin, []*APIKey{key(1, 100, 0, -1), key(2, 100, 0, -1)}, 1},
+		{"round-robin follows the last used", StrategyRoundRobin, []*APIKey{key(1, 100, 0, 1), key(2, 100, 0, 5), key(3, 100, 0, 2)}, 3},
+		{"round-robin skips missing IDs", StrategyRoundRobin, []*APIKey{key(2, 100, 0, 5), key(5, 100, 0, -1)}, 5},
+		{"round-robin wraps around", StrategyRoundRobin, []*APIKey{key(1, 100, 0, 1), key(2, 100, 0, 2), key(3, 100, 0, 9)}, 1},
+		{"least-recently-used", StrategyLRU, []*APIKey{key(1, 100, 0, 5), key(2, 100, 0, 2), key(3, 100, 0, 7)}, 2},
+		{"least-recently-used prefers unused", StrategyLRU, []*APIKey{key(1, 100, 0, 5), key(2, 100, 0, -1)}, 2},
+		{"drain most used", StrategyDrain, []*APIKey{key(1, 100, 10, 1), key(2, 100, 80, 1), key(3, 1000, 500, 1)}, 2},
+		{"drain first among equals", StrategyDrain, []*APIKey{key(1, 100, 0, 1), key(2, 100, 0, 1)}, 1},
+		{"weighted skips keys without credits", StrategyWeighted, []*APIKey{key(1, 100, 100, 1), key(2, 100, 40, 1), key(3, 50, 60, 1)}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := StrategyByName(tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strategy.Choose(tt.candidates); got.ID != tt.want {
+				t.Errorf("%s chose key %d, want %d", tt.strategy, got.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandomStrategiesChooseCandidates(t *testing.T) {
+	candidates := []*APIKey{
+		{ID: 1, QuotaLimit: 100},
+		{ID: 2, QuotaLimit: 0},
+		{ID: 3, QuotaLimit: 100, QuotaUsed: 100},
+	}
+	for _, name := range []string{StrategyWeighted, StrategyRandom} {
+		strategy, _ := StrategyByName(name)
+		seen := make(map[int]bool)
+		for range 1000 {
+			seen[strategy.Choose(candidates).ID] = true
+		}
+		if !seen[1] || !seen[2] {
+			t.Errorf("%s never chose some keys with credits: %v", name, seen)
+		}
+		if name == StrategyWeighted && seen[3] {
+			t.Errorf("%s chose a key without credits", name)
+		}
+	}
+
+	// Without any credits left, weighted falls back to a uniform choice
+	exhausted := []*APIKey{{ID: 1, QuotaLimit: 10, QuotaUsed: 10}, {ID: 2, QuotaLimit: 10, QuotaUsed: 12}}
+	strategy, _ := StrategyByName(StrategyWeighted)
+	if got := strategy.Choose(exhausted); got.ID != 1 && got.ID != 2 {
+		t.Errorf("weighted chose key %d outside the candidates", got.ID)
+	}
+}